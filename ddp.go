@@ -8,6 +8,7 @@ package ddp
 import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
+	"sort"
 	"sync"
 	"time"
 )
@@ -48,6 +49,17 @@ func (id *idManager) newID() string {
 	return fmt.Sprintf("%x", next)
 }
 
+// sortIDs sorts ids issued by newID in the order they were issued.
+func sortIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		// Hex counters without leading zeros
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) < len(ids[j])
+		}
+		return ids[i] < ids[j]
+	})
+}
+
 // -------------------------------------------------------------------
 
 // pingTracker tracks in-flight pings.
@@ -68,11 +80,31 @@ type Call struct {
 	Error         error         // After completion, the error status.
 	Done          chan *Call    // Strobes when call is complete.
 	Owner         *Client       // Client that owns the method call
+
+	into      interface{}   // Value to decode the result into (GoInto).
+	updated   chan struct{} // Closed when the server reports the method's writes are visible.
+	updateErr error         // Set before updated closes if the writes will never be reported.
+}
+
+// Updated returns a channel that is closed when the server sends the
+// method's updated message - all writes the method made are now reflected
+// in the client's collections. It may close before or after Done strobes.
+// Subscriptions never close it.
+func (call *Call) Updated() <-chan struct{} {
+	return call.updated
+}
+
+// markUpdated closes the updated channel. The client stops tracking the
+// call first so it is only called once.
+func (call *Call) markUpdated() {
+	close(call.updated)
 }
 
 // done removes the call from any owners and strobes the done channel with itself.
 func (call *Call) done() {
+	call.Owner.lock.Lock()
 	delete(call.Owner.calls, call.ID)
+	call.Owner.lock.Unlock()
 	select {
 	case call.Done <- call:
 		// ok
@@ -82,3 +114,87 @@ func (call *Call) done() {
 		log.WithField("method", call.ServiceMethod).Warn("rpc: discarding Call reply due to insufficient Done chan capacity")
 	}
 }
+
+// -------------------------------------------------------------------
+
+// Subscription represents an active livedata subscription. The embedded
+// Call strobes its Done channel when the server reports the subscription
+// ready, or when the server rejects it with a nosub - in which case
+// Error is set.
+type Subscription struct {
+	*Call
+
+	// ready is closed when the server reports the subscription ready.
+	ready chan struct{}
+	// stopped is closed when the subscription has ended.
+	stopped chan struct{}
+	// stopping is set once an unsub has been sent for the subscription.
+	// Protected by the owning client's lock.
+	stopping bool
+	// loaded is set once the server reports the subscription ready on the
+	// current connection. Protected by the owning client's lock.
+	loaded bool
+
+	// lock protects the error status once the subscription is shared.
+	lock      sync.Mutex
+	readyOnce sync.Once
+	stopOnce  sync.Once
+}
+
+// newSubscription wraps a subscription call.
+func newSubscription(call *Call) *Subscription {
+	return &Subscription{
+		Call:    call,
+		ready:   make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed when the server reports the
+// subscription ready or the subscription fails. Check Err to tell them
+// apart.
+func (sub *Subscription) Ready() <-chan struct{} {
+	return sub.ready
+}
+
+// Err returns the error status of the subscription. Unlike reading
+// Error directly, Err is safe to call while the subscription is active.
+func (sub *Subscription) Err() error {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.Error
+}
+
+// Stop ends the subscription by sending an unsub to the server and
+// waiting for the server to confirm with a nosub. Before confirming, the
+// server sends removed messages for documents that no other subscription
+// publishes, so the collections no longer hold this subscription's data
+// when Stop returns.
+func (sub *Subscription) Stop() error {
+	return sub.Owner.unsubscribe(sub)
+}
+
+// complete closes the ready channel and strobes the done channel. The
+// server resends ready after a reconnect so this may be called more than
+// once.
+func (sub *Subscription) complete() {
+	sub.readyOnce.Do(func() {
+		close(sub.ready)
+		sub.done()
+	})
+}
+
+// markStopped records the error (if any) the subscription ended with,
+// completes it for anyone still waiting on it being ready, and closes the
+// stopped channel.
+func (sub *Subscription) markStopped(err error) {
+	sub.stopOnce.Do(func() {
+		if err != nil {
+			sub.lock.Lock()
+			sub.Error = err
+			sub.lock.Unlock()
+		}
+		sub.complete()
+		close(sub.stopped)
+	})
+}
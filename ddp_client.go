@@ -1,8 +1,14 @@
 package ddp
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/websocket"
@@ -10,43 +16,103 @@ import (
 
 // Client represents a DDP client connection. The DDP client establish a DDP
 // session and acts as a message pump for other tools.
+//
+// A Client is safe for concurrent use by multiple goroutines. The exported
+// configuration fields should be set before the client is shared.
 type Client struct {
 	// HeartbeatInterval is the time between heartbeats to send
 	HeartbeatInterval time.Duration
 	// HeartbeatTimeout is the time for a heartbeat ping to timeout
 	HeartbeatTimeout time.Duration
-	// ReconnectInterval is the time between reconnections on bad connections
+	// ReconnectInterval is the initial time between reconnections on bad
+	// connections when no ReconnectPolicy is set
 	ReconnectInterval time.Duration
+	// ReconnectPolicy decides the delay between reconnection attempts. If
+	// nil, delays grow exponentially from ReconnectInterval.
+	ReconnectPolicy ReconnectPolicy
 
 	// reconnects in the number of reconnections the client has made
 	reconnects int64
+	// pingsSent is the number of pings the client has sent
+	pingsSent int64
+	// pingsRecv is the number of pings the client has received
+	pingsRecv int64
+	// mergeBox is set when the client merges subscriptions, see merger
+	mergeBox bool
+
+	// subLock serializes issuing and sending subscriptions, so their ids
+	// are in the order the server receives them.
+	subLock sync.Mutex
+
+	// lock protects all the fields below.
+	lock sync.Mutex
 
 	// session contains the DDP session token (can be used for reconnects and debugging).
 	session string
 	// version contains the negotiated DDP protocol version in use.
 	version string
+	// proposal is the DDP protocol version the client proposes when connecting.
+	proposal string
 	// serverID the cluster node ID for the server we connected to
 	serverID string
-	// ws is the underlying websocket being used.
-	ws *websocket.Conn
+	// conn is the current connection - nil while disconnected.
+	conn *connection
+	// closed is set when the client has been closed and should not reconnect.
+	closed bool
+	// stopErr is the error new calls and subscriptions fail with once the
+	// client won't connect again - nil while it may.
+	stopErr error
+	// reconnecting is set while the reconnect loop is running.
+	reconnecting bool
+	// dialLock serializes reconnect attempts.
+	dialLock sync.Mutex
+	// status is the current connection status.
+	status Status
+	// statusSignal is closed and replaced whenever the status changes.
+	statusSignal chan struct{}
+	// statusHandlers are notified of status changes.
+	statusHandlers []func(Status)
+	// statusQueue holds status changes waiting to be delivered.
+	statusQueue []Status
+	// notifying is set while a goroutine delivers status changes.
+	notifying bool
+	// readStats tracks reads on the current connection.
+	readStats *statsTracker
+	// totalReads tracks reads across all connections.
+	totalReads *statsTracker
+	// writeStats tracks writes on the current connection.
+	writeStats *statsTracker
+	// totalWrites tracks writes across all connections.
+	totalWrites *statsTracker
 	// url the URL the websocket is connected to
 	url string
 	// origin is the origin for the websocket connection
 	origin string
+	// config is used to dial the websocket on every connection
+	config *websocket.Config
+	// dialOptions holds the settings set by options for dialing
+	dialOptions dialOptions
 	// inbox is an incoming message channel
-	inbox chan map[string]interface{}
-	// errors is an incoming errors channel
-	errors chan error
+	inbox chan *inboxEvent
+	// done is closed when the client is closed, stopping the inboxManager
+	// and the reconnect loop - nil while the inboxManager isn't running.
+	done chan struct{}
 	// pingTimer is a timer for sending regular pings to the server
 	pingTimer *time.Timer
 	// pings tracks inflight pings based on each ping ID.
 	pings map[string][]*pingTracker
 	// calls tracks method invocations that are still in flight
 	calls map[string]*Call
-	// subs tracks active subscriptions. Map contains name->args
-	subs map[string]*Call
+	// updates tracks method invocations waiting for an updated message
+	updates map[string]*Call
+	// subs tracks active subscriptions by subscription ID
+	subs map[string]*Subscription
 	// collections contains all the collections currently subscribed
 	collections map[string]Collection
+	// consistencyHandlers are registered with every collection
+	consistencyHandlers []func(*ConsistencyError)
+	// resync is set while waiting for resent data after a reconnect
+	resync *resync
 
 	// idManager tracks IDs for ddp messages
 	idManager
@@ -58,101 +124,288 @@ type Client struct {
 // connection session before returning the client. The client will
 // automatically and internally handle heartbeats and reconnects.
 //
-// TBD create an option to use an external websocket (aka htt.Transport)
-// TBD create an option to substitute heartbeat and reconnect behavior (aka http.Tranport)
+// NewClient is equivalent to Dial(url, WithOrigin(origin)).
+//
 // TBD create an option to hijack the connection (aka http.Hijacker)
 // TBD create profiling features (aka net/http/pprof)
 func NewClient(url, origin string) (*Client, error) {
-	ws, err := websocket.Dial(url, "", origin)
-	if err != nil {
-		return nil, err
-	}
+	return Dial(url, WithOrigin(origin))
+}
+
+// Dial creates a client connected to the DDP server at url, configured by
+// opts. See DialContext.
+func Dial(url string, opts ...Option) (*Client, error) {
+	return DialContext(context.Background(), url, opts...)
+}
+
+// DialContext creates a client connected to the DDP server at url. It
+// returns once the DDP handshake completes and the session is established,
+// so Session and Version are immediately valid. If the context is done or
+// the handshake timeout expires before then, the server can't be reached,
+// or the server refuses the connection, DialContext returns a descriptive
+// error. The client negotiates the DDP protocol version with the server and
+// returns an error wrapping a *VersionError if they have no version in
+// common.
+//
+// The url is usually a websocket endpoint such as ws://host/websocket. An
+// http(s) base URL such as https://host/ connects to the app's SockJS
+// endpoint instead.
+func DialContext(ctx context.Context, url string, opts ...Option) (*Client, error) {
 	c := &Client{
 		HeartbeatInterval: 45 * time.Second, // Meteor impl default + 10 (we ping last)
 		HeartbeatTimeout:  15 * time.Second, // Meteor impl default
 		ReconnectInterval: 5 * time.Second,
 		collections:       map[string]Collection{},
-		ws:                ws,
 		url:               url,
-		origin:            origin,
-		inbox:             make(chan map[string]interface{}, 100),
-		errors:            make(chan error, 100),
+		inbox:             make(chan *inboxEvent, 100),
 		pings:             map[string][]*pingTracker{},
 		calls:             map[string]*Call{},
-		subs:              map[string]*Call{},
+		updates:           map[string]*Call{},
+		subs:              map[string]*Subscription{},
+		readStats:         newStatsTracker(),
+		totalReads:        newStatsTracker(),
+		writeStats:        newStatsTracker(),
+		totalWrites:       newStatsTracker(),
+		proposal:          supportedVersions[0],
+		statusSignal:      make(chan struct{}),
+		dialOptions: dialOptions{
+			header:           http.Header{},
+			handshakeTimeout: 15 * time.Second, // Meteor impl default heartbeat timeout
+		},
 
 		idManager: *newidManager(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.origin == "" {
+		c.origin = defaultOrigin(url)
+	}
+	config, err := c.newConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("ddp: invalid server %s: %v", url, err)
+	}
+	c.config = config
+	if isSockJSBase(config.Location) {
+		c.dialOptions.sockJS = true
+	}
+
+	if c.dialOptions.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dialOptions.handshakeTimeout)
+		defer cancel()
+	}
+	transport, err := c.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ddp: %v", err)
+	}
 
 	// We spin off an inbox processing goroutine
-	go c.inboxManager()
+	c.startInbox()
 
 	// Start DDP connection
-	c.start(ws, NewConnect())
+	c.start(transport, c.connectMessage(), nil)
+
+	if err := c.waitForHandshake(ctx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("ddp: handshake with %s failed: %w", url, err)
+	}
 
 	return c, nil
 }
 
 // Session returns the negotiated session token for the connection.
 func (c *Client) Session() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.session
 }
 
 // Version returns the negotiated protocol version in use by the client.
 func (c *Client) Version() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.version
 }
 
-// Reconnect attempts to reconnect the client to the server on the existing
-// DDP session.
-//
-// TODO needs a reconnect backoff so we don't trash a down server
-// TODO reconnect should not allow more reconnects while a reconnection is already in progress.
+// Reconnect reconnects the client to the server on the existing DDP
+// session, dropping the current connection if there is one. Reconnecting a
+// closed client reopens it. If the attempt fails the client keeps trying
+// according to its ReconnectPolicy.
 func (c *Client) Reconnect() {
+	c.startInbox()
+	c.lock.Lock()
+	c.closed = false
+	c.stopErr = nil
+	conn := c.conn
+	c.lock.Unlock()
+	if conn != nil {
+		c.dropConnection(conn)
+	}
+
+	if err := c.reconnect(); err != nil {
+		c.startReconnectLoop()
+	}
+}
+
+// startReconnectLoop starts the reconnect loop unless the client is closed
+// or a loop is already running.
+func (c *Client) startReconnectLoop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed || c.reconnecting {
+		return
+	}
+	c.reconnecting = true
+	go c.reconnectLoop(c.done)
+}
+
+// reconnectLoop attempts to reconnect, backing off between attempts, until
+// it succeeds, the client is closed (done is closed), or the
+// ReconnectPolicy gives up.
+func (c *Client) reconnectLoop(done <-chan struct{}) {
+	defer func() {
+		c.lock.Lock()
+		c.reconnecting = false
+		c.lock.Unlock()
+	}()
+	policy := c.ReconnectPolicy
+	if policy == nil {
+		policy = NewExponentialBackoff(c.ReconnectInterval, 5*time.Minute)
+	}
+	for attempt := 1; ; attempt++ {
+		delay, ok := policy.Backoff(attempt)
+		if !ok {
+			log.WithField("target", c.url).WithField("attempts", attempt-1).Warn("Giving up reconnecting")
+			c.stop(errGaveUp)
+			c.setState(Failed, nil)
+			return
+		}
+		c.updateStatus(func(status *Status) {
+			status.State = Waiting
+			status.RetryCount = attempt - 1
+			status.NextRetry = time.Now().Add(delay)
+		})
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+		if err := c.reconnect(); err == nil || err == errClientClosed {
+			return
+		}
+	}
+}
+
+// reconnect makes a single attempt to reconnect. It does nothing if the
+// client is already connected.
+func (c *Client) reconnect() error {
+	c.dialLock.Lock()
+	defer c.dialLock.Unlock()
 
-	c.Close()
+	c.lock.Lock()
+	closed, connected := c.closed, c.conn != nil
+	c.lock.Unlock()
+	if closed {
+		return errClientClosed
+	}
+	if connected {
+		return nil
+	}
 
-	c.reconnects++
+	atomic.AddInt64(&c.reconnects, 1)
+	c.updateStatus(func(status *Status) {
+		status.State = Connecting
+		status.RetryCount++
+		status.NextRetry = time.Time{}
+	})
 
 	// Reconnect
-	ws, err := websocket.Dial(c.url, "", c.origin)
+	ctx := context.Background()
+	if c.dialOptions.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dialOptions.handshakeTimeout)
+		defer cancel()
+	}
+	transport, err := c.dial(ctx)
 	if err != nil {
 		log.WithField("target", c.url).WithField("origin", c.origin).WithError(err).Warn("Dial error")
-		// Reconnect again after set interval
-		time.AfterFunc(c.ReconnectInterval, c.Reconnect)
-		return
+		c.setState(Waiting, err)
+		return err
 	}
 
-	c.start(ws, NewReconnect(c.session))
-
 	// --------------------------------------------------------------------
 	// We resume inflight or ongoing subscriptions - we don't have to wait
-	// for connection confirmation (messages can be pipelined).
+	// for connection confirmation (messages can be pipelined). The
+	// collections keep their documents until the resent data is complete,
+	// see resync.
 	// --------------------------------------------------------------------
 
-	// Send calls that haven't been confirmed - may not have been sent
-	// and effects should be idempotent
-	for _, call := range c.calls {
-		log.WithField("method", call.ServiceMethod).Info("resending inflight method")
-		c.Send(NewMethod(call.ID, call.ServiceMethod, call.Args))
+	var resend []interface{}
+	var stopped []*Subscription
+	prepare := func() {
+		r := c.beginResync()
+		resend = make([]interface{}, 0, len(c.calls)+len(c.subs))
+		// Send calls that haven't been confirmed - may not have been sent
+		// and effects should be idempotent
+		for _, call := range c.calls {
+			log.WithField("method", call.ServiceMethod).Info("resending inflight method")
+			resend = append(resend, NewMethod(call.ID, call.ServiceMethod, call.Args))
+			r.methods[call.ID] = true
+		}
+		// Calls that already have a result will never see an updated on
+		// the new connection. Their writes are in the data the resent
+		// subscriptions deliver so we release them with it.
+		for id, call := range c.updates {
+			if _, ok := c.calls[id]; !ok {
+				delete(c.updates, id)
+				r.after = append(r.after, call.markUpdated)
+			}
+		}
+		// Resend subscriptions in the order they were first sent.
+		// Subscriptions that were being stopped are simply dropped - the
+		// new connection never knew about them.
+		ids := make([]string, 0, len(c.subs))
+		for id := range c.subs {
+			ids = append(ids, id)
+		}
+		sortIDs(ids)
+		for _, id := range ids {
+			sub := c.subs[id]
+			if sub.stopping {
+				delete(c.subs, sub.ID)
+				stopped = append(stopped, sub)
+				continue
+			}
+			log.WithField("method", sub.ServiceMethod).Info("restarting active subscription")
+			resend = append(resend, NewSub(sub.ID, sub.ServiceMethod, sub.Args))
+			r.subs[sub.ID] = true
+			sub.loaded = false
+		}
+	}
+	// New subscriptions wait until the resent ones are out
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+	if err := c.start(transport, c.connectMessage(), prepare); err != nil {
+		return err
 	}
 
-	// Resend subscriptions and patch up collections
-	for _, sub := range c.subs {
-		log.WithField("method", sub.ServiceMethod).Info("restarting active subscription")
-		c.Send(NewSub(sub.ID, sub.ServiceMethod, sub.Args))
+	for _, sub := range stopped {
+		sub.markStopped(nil)
 	}
-	// Patching up the collections right now is just resetting them. There
-	// must be a better way but this is quick and works.
-	for _, collection := range c.collections {
-		collection.Reset()
+	for _, msg := range resend {
+		c.Send(msg)
 	}
+	return nil
 }
 
-// Subscribe subscribes to data updates.
-func (c *Client) Subscribe(subName string, args []interface{}, done chan *Call) *Call {
+// Subscribe subscribes to data updates. The done channel will signal when
+// the subscription is ready. The returned Subscription can be used to stop
+// the subscription.
+func (c *Client) Subscribe(subName string, args []interface{}, done chan *Call) *Subscription {
 	call := new(Call)
-	call.ID = c.newID()
 	call.ServiceMethod = subName
 	call.Args = args
 	call.Owner = c
@@ -168,23 +421,137 @@ func (c *Client) Subscribe(subName string, args []interface{}, done chan *Call)
 		}
 	}
 	call.Done = done
-	c.subs[call.ID] = call
-
-	// Save this subscription to the client so we can reconnect
-	subArgs := make([]interface{}, len(args))
-	copy(subArgs, args)
+	sub := newSubscription(call)
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+	call.ID = c.newID()
+	c.lock.Lock()
+	if err := c.stopErr; err != nil {
+		c.lock.Unlock()
+		sub.markStopped(err)
+		return sub
+	}
+	c.subs[call.ID] = sub
+	c.lock.Unlock()
 
 	c.Send(NewSub(call.ID, subName, args))
 
-	return call
+	return sub
 }
 
-// Sub sends a synchronous subscription request to the server.
+// unsubscribe sends an unsub for the subscription and waits for the
+// server to confirm it.
+func (c *Client) unsubscribe(sub *Subscription) error {
+	c.lock.Lock()
+	_, ok := c.subs[sub.ID]
+	if !ok || sub.stopping {
+		c.lock.Unlock()
+		// Already stopped or stopping
+		<-sub.stopped
+		return nil
+	}
+	sub.stopping = true
+	c.lock.Unlock()
+
+	err := c.Send(NewUnsub(sub.ID))
+	if err != nil {
+		// The server will forget the subscription when we reconnect
+		c.lock.Lock()
+		delete(c.subs, sub.ID)
+		c.lock.Unlock()
+		sub.markStopped(nil)
+		return err
+	}
+	<-sub.stopped
+	return nil
+}
+
+// stop ends every subscription and method call in flight with err, and
+// makes new ones fail with it, when the client won't connect again.
+func (c *Client) stop(err error) {
+	c.lock.Lock()
+	c.stopErr = err
+	calls, updates := c.calls, c.updates
+	c.calls = map[string]*Call{}
+	c.updates = map[string]*Call{}
+	var after []func()
+	if r := c.resync; r != nil {
+		// The resent data will never be complete
+		after = r.after
+		c.resync = nil
+	}
+	c.lock.Unlock()
+	c.stopSubs(err)
+	for _, call := range calls {
+		call.Error = err
+		call.done()
+	}
+	for _, call := range updates {
+		call.updateErr = err
+		call.markUpdated()
+	}
+	for _, fn := range after {
+		fn()
+	}
+}
+
+// stopSubs ends every subscription with err, releasing anyone waiting on
+// them.
+func (c *Client) stopSubs(err error) {
+	c.lock.Lock()
+	subs := make([]*Subscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	c.subs = map[string]*Subscription{}
+	c.lock.Unlock()
+	for _, sub := range subs {
+		sub.markStopped(err)
+	}
+}
+
+// Sub sends a synchronous subscription request to the server. It returns
+// once the subscription is ready, or with an *Error if the server rejects
+// the subscription.
 func (c *Client) Sub(subName string, args []interface{}) error {
 	call := <-c.Subscribe(subName, args, make(chan *Call, 1)).Done
 	return call.Error
 }
 
+// SubContext sends a subscription request to the server and waits for it to
+// become ready. If the context is done first the subscription is abandoned:
+// an unsub is sent to the server, the subscription is forgotten, and
+// ctx.Err() is returned.
+func (c *Client) SubContext(ctx context.Context, subName string, args ...interface{}) (*Subscription, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	sub := c.Subscribe(subName, args, make(chan *Call, 1))
+	select {
+	case <-sub.Ready():
+		if err := sub.Err(); err != nil {
+			return nil, err
+		}
+		return sub, nil
+	case <-ctx.Done():
+		c.abandonSub(sub, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// abandonSub forgets a subscription and asks the server to stop it without
+// waiting for confirmation.
+func (c *Client) abandonSub(sub *Subscription, err error) {
+	c.lock.Lock()
+	_, ok := c.subs[sub.ID]
+	delete(c.subs, sub.ID)
+	c.lock.Unlock()
+	if ok {
+		c.Send(NewUnsub(sub.ID))
+	}
+	sub.markStopped(err)
+}
+
 // Go invokes the function asynchronously.  It returns the Call structure representing
 // the invocation.  The done channel will signal when the call is complete by returning
 // the same Call object.  If done is nil, Go will allocate a new channel.
@@ -192,12 +559,28 @@ func (c *Client) Sub(subName string, args []interface{}) error {
 //
 // Go and Call are modeled after the standard `net/rpc` package versions.
 func (c *Client) Go(serviceMethod string, args []interface{}, done chan *Call) *Call {
+	return c.goCall(serviceMethod, args, nil, done)
+}
+
+// GoInto invokes the function asynchronously like Go, decoding the EJSON
+// result into reply, which must be a pointer to a struct, slice, map or
+// other value encoding/json can decode into. When the call completes
+// Call.Reply is reply, or Call.Error is set if the result could not be
+// decoded.
+func (c *Client) GoInto(serviceMethod string, args []interface{}, reply interface{}, done chan *Call) *Call {
+	return c.goCall(serviceMethod, args, reply, done)
+}
+
+// goCall sends a method call, optionally decoding the result into reply.
+func (c *Client) goCall(serviceMethod string, args []interface{}, reply interface{}, done chan *Call) *Call {
 
 	call := new(Call)
 	call.ID = c.newID()
 	call.ServiceMethod = serviceMethod
 	call.Args = args
 	call.Owner = c
+	call.into = reply
+	call.updated = make(chan struct{})
 	if done == nil {
 		done = make(chan *Call, 10) // buffered.
 	} else {
@@ -210,27 +593,115 @@ func (c *Client) Go(serviceMethod string, args []interface{}, done chan *Call) *
 		}
 	}
 	call.Done = done
+	c.lock.Lock()
+	if err := c.stopErr; err != nil {
+		c.lock.Unlock()
+		call.Error = err
+		call.updateErr = err
+		call.markUpdated()
+		call.done()
+		return call
+	}
 	c.calls[call.ID] = call
+	c.updates[call.ID] = call
+	c.lock.Unlock()
 
-	c.Send(NewMethod(call.ID, serviceMethod, args))
+	if err := c.Send(NewMethod(call.ID, serviceMethod, args)); err != nil {
+		// The call stays in flight and is resent when the client
+		// reconnects, or ends with an error if it never does
+		log.WithField("method", serviceMethod).WithError(err).Info("method will be sent on reconnect")
+	}
 
 	return call
 }
 
 // Call invokes the named function, waits for it to complete, and returns its error status.
+// Errors thrown by the method on the server are returned as an *Error.
 func (c *Client) Call(serviceMethod string, args []interface{}) (interface{}, error) {
 	call := <-c.Go(serviceMethod, args, make(chan *Call, 1)).Done
 	return call.Reply, call.Error
 }
 
+// CallContext invokes the named function and waits for it to complete or
+// for the context to be done. If the context is done first the call is
+// forgotten - any result the server sends later is dropped - and
+// ctx.Err() is returned.
+func (c *Client) CallContext(ctx context.Context, serviceMethod string, args ...interface{}) (interface{}, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	call := c.Go(serviceMethod, args, make(chan *Call, 1))
+	select {
+	case <-call.Done:
+		return call.Reply, call.Error
+	case <-ctx.Done():
+		c.forgetCall(call)
+		return nil, ctx.Err()
+	}
+}
+
+// CallAndWaitForData invokes the named function like CallContext but only
+// returns once the server has also sent the method's updated message. At
+// that point every write the method made is reflected in the client's
+// collections, so they can be read right away for consistent data.
+func (c *Client) CallAndWaitForData(ctx context.Context, serviceMethod string, args ...interface{}) (interface{}, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	call := c.Go(serviceMethod, args, make(chan *Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		c.forgetCall(call)
+		return nil, ctx.Err()
+	}
+	select {
+	case <-call.Updated():
+		if call.Error == nil && call.updateErr != nil {
+			return nil, call.updateErr
+		}
+		return call.Reply, call.Error
+	case <-ctx.Done():
+		c.forgetCall(call)
+		return nil, ctx.Err()
+	}
+}
+
+// forgetCall stops tracking a method call so late messages for it are
+// dropped.
+func (c *Client) forgetCall(call *Call) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.calls, call.ID)
+	delete(c.updates, call.ID)
+}
+
+// CallInto invokes the named function like CallContext, decoding the EJSON
+// result into reply, which must be a pointer to a struct, slice, map or
+// other value encoding/json can decode into. A method that returns nothing
+// leaves reply untouched.
+func (c *Client) CallInto(ctx context.Context, reply interface{}, serviceMethod string, args ...interface{}) error {
+	result, err := c.CallContext(ctx, serviceMethod, args...)
+	if err != nil {
+		return err
+	}
+	return decodeEJSON(result, reply)
+}
+
 // Ping sends a heartbeat signal to the server. The Ping doesn't look for
 // a response but may trigger the connection to reconnect if the ping timesout.
 // This is primarily useful for reviving an unresponsive Client connection.
 func (c *Client) Ping() {
 	c.PingPong(c.newID(), c.HeartbeatTimeout, func(err error) {
 		if err != nil {
-			// Is there anything else we should or can do?
-			go c.Reconnect()
+			// The connection is unresponsive - drop it and reconnect
+			c.lock.Lock()
+			conn := c.conn
+			c.lock.Unlock()
+			if conn != nil && c.dropConnection(conn) {
+				c.setState(Waiting, err)
+				c.startReconnectLoop()
+			}
 		}
 	})
 }
@@ -240,247 +711,696 @@ func (c *Client) Ping() {
 // track the responses - or an empty string can be used. It is the
 // responsibility of the caller to respond to any errors that may occur.
 func (c *Client) PingPong(id string, timeout time.Duration, handler func(error)) {
+	tracker := &pingTracker{handler: handler, timeout: timeout}
+	// Track the ping before sending so a fast pong can't be missed
+	c.lock.Lock()
+	c.pings[id] = append(c.pings[id], tracker)
+	tracker.timer = time.AfterFunc(timeout, func() {
+		if c.removePing(id, tracker) {
+			handler(fmt.Errorf("ping timeout"))
+		}
+	})
+	c.lock.Unlock()
+
 	err := c.Send(NewPing(id))
 	if err != nil {
-		handler(err)
+		if c.removePing(id, tracker) {
+			tracker.timer.Stop()
+			handler(err)
+		}
 		return
 	}
-	pings, ok := c.pings[id]
-	if !ok {
-		pings = make([]*pingTracker, 0, 5)
+	atomic.AddInt64(&c.pingsSent, 1)
+}
+
+// removePing stops tracking a ping, returning false if it had already been
+// removed (answered, timed out or failed).
+func (c *Client) removePing(id string, tracker *pingTracker) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pings := c.pings[id]
+	for i, ping := range pings {
+		if ping == tracker {
+			pings = append(pings[:i:i], pings[i+1:]...)
+			if len(pings) > 0 {
+				c.pings[id] = pings
+			} else {
+				delete(c.pings, id)
+			}
+			return true
+		}
 	}
-	tracker := &pingTracker{handler: handler, timeout: timeout, timer: time.AfterFunc(timeout, func() {
-		handler(fmt.Errorf("ping timeout"))
-	})}
-	c.pings[id] = append(pings, tracker)
+	return false
 }
 
 // Send transmits messages to the server. The msg parameter must be json
 // encoder compatible.
 func (c *Client) Send(msg interface{}) error {
 	log.WithField("message", msg).Debug("send")
-	if c.ws == nil {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+	if conn == nil {
 		return fmt.Errorf("Tried to send message on a nil socket")
-	} else {
-		return websocket.JSON.Send(c.ws, msg)
 	}
+	return conn.send(msg)
 }
 
-// Close implements the io.Closer interface.
+// errClientClosed is returned when reconnecting a closed client.
+var errClientClosed = fmt.Errorf("client is closed")
+
+// errGaveUp ends the subscriptions and calls of a client that gave up
+// reconnecting.
+var errGaveUp = fmt.Errorf("client gave up reconnecting")
+
+// Close implements the io.Closer interface. A closed client stops
+// reconnecting and goes Offline. Its subscriptions and method calls in
+// flight end with an error, as do any made until it is reconnected.
 func (c *Client) Close() {
-	// Shutdown out all outstanding pings
-	c.pingTimer.Stop()
-	// Close websocket
-	if c.ws != nil {
-		c.ws.Close()
-		c.ws = nil
+	c.lock.Lock()
+	c.closed = true
+	conn := c.conn
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	c.lock.Unlock()
+	if conn != nil {
+		c.dropConnection(conn)
 	}
+	c.stop(errClientClosed)
+	c.setState(Offline, nil)
 }
 
 // ResetStats resets the statistics for the client.
 func (c *Client) ResetStats() {
-	c.reconnects = 0
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readStats.reset()
+	c.totalReads.reset()
+	c.writeStats.reset()
+	c.totalWrites.reset()
+	atomic.StoreInt64(&c.reconnects, 0)
+	atomic.StoreInt64(&c.pingsSent, 0)
+	atomic.StoreInt64(&c.pingsRecv, 0)
+}
+
+// Stats returns the read and write statistics for the client.
+func (c *Client) Stats() *ClientStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &ClientStats{
+		Reads:       c.readStats.snapshot(),
+		TotalReads:  c.totalReads.snapshot(),
+		Writes:      c.writeStats.snapshot(),
+		TotalWrites: c.totalWrites.snapshot(),
+		Reconnects:  atomic.LoadInt64(&c.reconnects),
+		PingsSent:   atomic.LoadInt64(&c.pingsSent),
+		PingsRecv:   atomic.LoadInt64(&c.pingsRecv),
+	}
 }
 
 // CollectionByName retrieves a collection by it's name.
 func (c *Client) CollectionByName(name string) Collection {
-	collection, ok := c.collections[name]
-	if !ok {
-		collection = NewCollection(name)
-		c.collections[name] = collection
-	}
-	return collection
+	return c.CollectionByNameWithDefault(name, NewCollection)
 }
 
 // CollectionByNameWithDefault retrieves a collection by it's name,
 // and if one did not exist defaults to the one returned by the given
 // function.
 func (c *Client) CollectionByNameWithDefault(name string, makeDefault func(string) Collection) Collection {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	collection, ok := c.collections[name]
 	if !ok {
 		collection = makeDefault(name)
 		c.collections[name] = collection
+		if box, ok := collection.(merger); ok && c.mergeBox {
+			box.trackOwners()
+		}
+		if reporter, ok := collection.(consistencyReporter); ok {
+			for _, handler := range c.consistencyHandlers {
+				reporter.OnConsistencyError(handler)
+			}
+		}
 	}
 	return collection
 }
 
-// start starts a new client connection on the provided websocket
-func (c *Client) start(ws *websocket.Conn, connect *Connect) {
-	c.ws = ws
+// OnConsistencyError registers a function that is called when the server
+// changes or removes a document missing from one of the client's
+// collections. It applies to current and future collections that report
+// these errors, such as the default KeyCache.
+func (c *Client) OnConsistencyError(handler func(*ConsistencyError)) {
+	c.lock.Lock()
+	c.consistencyHandlers = append(c.consistencyHandlers, handler)
+	collections := make([]Collection, 0, len(c.collections))
+	for _, collection := range c.collections {
+		collections = append(collections, collection)
+	}
+	c.lock.Unlock()
+	for _, collection := range collections {
+		if reporter, ok := collection.(consistencyReporter); ok {
+			reporter.OnConsistencyError(handler)
+		}
+	}
+}
+
+// connectMessage creates the connect message for a new connection,
+// resuming the current session if there is one.
+func (c *Client) connectMessage() *Connect {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	connect := NewConnectVersion(c.proposal)
+	connect.Session = c.session
+	return connect
+}
+
+// negotiate handles a failed message, where the server rejects our
+// proposed protocol version and suggests one of its own. If we support
+// the suggestion we reconnect proposing it, otherwise the client fails
+// and stops reconnecting.
+func (c *Client) negotiate(suggested string) {
+	c.lock.Lock()
+	conn := c.conn
+	supported := false
+	for _, version := range supportedVersions {
+		if version == suggested && version != c.proposal {
+			supported = true
+		}
+	}
+	if supported {
+		c.proposal = suggested
+	} else {
+		c.closed = true
+	}
+	c.lock.Unlock()
+
+	// The server closes the connection after failed - we don't want
+	// that to look like a dropped connection.
+	if conn != nil {
+		c.dropConnection(conn)
+	}
+	if !supported {
+		// Copy so callers can't change the versions we support
+		versions := make([]string, len(supportedVersions))
+		copy(versions, supportedVersions)
+		err := &VersionError{Suggested: suggested, Supported: versions}
+		log.WithError(err).Error("DDP version negotiation failed")
+		c.stop(err)
+		c.setState(Failed, err)
+		return
+	}
+	log.WithField("version", suggested).Info("Retrying with the server's DDP version")
+	go func() {
+		if err := c.reconnect(); err != nil {
+			c.startReconnectLoop()
+		}
+	}()
+}
+
+// start starts a new client connection on the provided transport. The
+// transport is closed instead if the client was closed while dialing.
+// prepare, if not nil, is called with the lock held just before the
+// connection becomes current.
+func (c *Client) start(transport Transport, connect *Connect, prepare func()) error {
+	// Every connection gets fresh stats that also feed the client totals.
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		transport.Close()
+		return errClientClosed
+	}
+	c.readStats = newStatsTracker()
+	c.writeStats = newStatsTracker()
+	stats := &transportStats{
+		Transport: transport,
+		reads:     []*statsTracker{c.readStats, c.totalReads},
+		writes:    []*statsTracker{c.writeStats, c.totalWrites},
+	}
+	conn := newConnection(stats)
+	stats.closed = conn.isClosed
+	if prepare != nil {
+		prepare()
+	}
+	c.conn = conn
+	c.lock.Unlock()
+
+	// We spin off inbox stuffing and outbox draining goroutines
+	c.setState(Connecting, nil)
 
-	// We spin off an inbox stuffing goroutine
-	go c.inboxWorker(ws)
+	go c.inboxWorker(conn)
+	go conn.outboxWorker()
 
 	c.Send(connect)
+	return nil
+}
+
+// dropConnection closes the connection and detaches it from the client if
+// it is still the current connection. It returns true if this call closed
+// the connection.
+func (c *Client) dropConnection(conn *connection) bool {
+	c.lock.Lock()
+	if c.conn == conn {
+		c.conn = nil
+		if c.pingTimer != nil {
+			// Shutdown out all outstanding pings
+			c.pingTimer.Stop()
+		}
+	}
+	c.lock.Unlock()
+	return conn.close()
+}
+
+// heartbeat pings the server while the client is connected.
+func (c *Client) heartbeat() {
+	c.lock.Lock()
+	connected := c.conn != nil
+	c.lock.Unlock()
+	if connected {
+		c.Ping()
+		c.resetPingTimer()
+	}
+}
+
+// resetPingTimer delays the next heartbeat - any traffic from the server
+// shows the connection is alive.
+func (c *Client) resetPingTimer() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pingTimer != nil {
+		c.pingTimer.Reset(c.HeartbeatInterval)
+	}
 }
 
 // inboxManager pulls messages from the inbox and routes them to appropriate
-// handlers.
-func (c *Client) inboxManager() {
+// handlers until stop is closed.
+func (c *Client) inboxManager(stop <-chan struct{}) {
 	for {
+		var event *inboxEvent
 		select {
-		case msg := <-c.inbox:
-			log.WithField("message", msg).Info("inbox")
-			// Message!
-			mtype, ok := msg["msg"]
+		case event = <-c.inbox:
+		case <-stop:
+			return
+		}
+		if event.msg == nil {
+			c.disconnected(event.conn, event.err)
+			continue
+		}
+		log.WithField("message", event.raw).Info("inbox")
+		switch msg := event.msg.(type) {
+
+		// Connection management
+		case *ConnectedMessage:
+			c.lock.Lock()
+			// The server only accepts the version we proposed
+			c.version = c.proposal
+			c.session = msg.Session
+			// Start automatic heartbeats - pre1 servers don't
+			// support them
+			if c.pingTimer != nil {
+				c.pingTimer.Stop()
+				c.pingTimer = nil
+			}
+			if c.version != "pre1" {
+				c.pingTimer = time.AfterFunc(c.HeartbeatInterval, c.heartbeat)
+			}
+			current := c.conn == event.conn
+			c.lock.Unlock()
+			c.updateStatus(func(status *Status) {
+				*status = Status{State: Connected}
+			})
+			if current {
+				// Without resent subscriptions or methods there is
+				// nothing to wait for
+				c.settleResync(nil, nil)
+			}
+		case *FailedMessage:
+			c.negotiate(msg.Version)
+		case *serverID:
+			// Current Meteor server sends an undocumented DDP message
+			// (looks like clustering "hint"). We will register and
+			// ignore rather than log an error.
+			c.lock.Lock()
+			c.serverID = msg.ServerID
+			c.lock.Unlock()
+		case *ErrorMessage:
+			log.WithField("reason", msg.Reason).WithField("offending", msg.OffendingMessage).Error("Server reported a protocol error")
+
+		// Heartbeats
+		case *Ping:
+			// We received a ping - need to respond with a pong
+			atomic.AddInt64(&c.pingsRecv, 1)
+			c.Send(NewPong(msg.ID))
+		case *Pong:
+			// We received a pong - we can clear the ping tracker and call its handler
+			c.lock.Lock()
+			var ping *pingTracker
+			if pings := c.pings[msg.ID]; len(pings) > 0 {
+				ping = pings[0]
+			}
+			c.lock.Unlock()
+			if ping != nil && c.removePing(msg.ID, ping) {
+				ping.timer.Stop()
+				ping.handler(nil)
+			}
+
+		// Live Data
+		case *NoSubMessage:
+			log.WithField("message", event.raw).Info("Subscription returned a nosub error")
+			// Clear related subscriptions and report any error
+			c.lock.Lock()
+			sub, ok := c.subs[msg.ID]
+			delete(c.subs, msg.ID)
+			c.lock.Unlock()
+			if c.mergeBox {
+				id := msg.ID
+				c.whenResynced(func() { c.release(id) })
+			}
 			if ok {
-				switch mtype.(string) {
-
-				// Connection management
-				case "connected":
-					c.version = "1" // Currently the only version we support
-					c.session = msg["session"].(string)
-					// Start automatic heartbeats
-					c.pingTimer = time.AfterFunc(c.HeartbeatInterval, func() {
-						if c.ws != nil {
-							c.Ping()
-							c.pingTimer.Reset(c.HeartbeatInterval)
-						}
-					})
-				case "failed":
-					log.WithField("version", msg["version"]).Fatal("IM Failed to connect, we only support version 1")
-
-				// Heartbeats
-				case "ping":
-					// We received a ping - need to respond with a pong
-					id, ok := msg["id"]
-					if ok {
-						c.Send(NewPong(id.(string)))
-					} else {
-						c.Send(NewPong(""))
-					}
-				case "pong":
-					// XXX WEIRD
-					// We received a pong - we can clear the ping tracker and call its handler
-					id, ok := msg["id"]
-					var key string
-					if ok {
-						key = id.(string)
-					}
-					pings, ok := c.pings[key]
-					if ok && len(pings) > 0 {
-						ping := pings[0]
-						pings = pings[1:]
-						if len(key) == 0 || len(pings) > 0 {
-							c.pings[key] = pings
-						}
-						ping.timer.Stop()
-						ping.handler(nil)
-					}
-
-				// Live Data
-				case "nosub":
-					log.WithField("message", msg).Info("Subscription returned a nosub error")
-					// Clear related subscriptions=
-					sub, ok := msg["id"]
-					if ok {
-						delete(c.subs, sub.(string))
-					}
-				case "ready":
-					// Run 'done' callbacks on all ready subscriptions
-					subs, ok := msg["subs"]
-					if ok {
-						for _, sub := range subs.([]interface{}) {
-							call, ok := c.subs[sub.(string)]
-							if ok {
-								call.done()
-							}
-						}
-					}
-				case "added":
-					c.collectionBy(msg).Added(msg)
-				case "changed":
-					c.collectionBy(msg).Changed(msg)
-				case "removed":
-					c.collectionBy(msg).Removed(msg)
-				case "addedBefore":
-					c.collectionBy(msg).AddedBefore(msg)
-				case "movedBefore":
-					c.collectionBy(msg).MovedBefore(msg)
-
-				// RPC
-				case "result":
-					id, ok := msg["id"]
-					if ok {
-						call := c.calls[id.(string)]
-						if call != nil {
-							delete(c.calls, id.(string))
-							e, ok := msg["error"]
-							if ok {
-								call.Error = fmt.Errorf(e.(string))
-							} else {
-								call.Reply = msg["result"]
-							}
-							call.done()
-						}
-					}
-				case "updated":
-					// We currently don't do anything with updated status
-
-				default:
-					// Ignore?
-					log.WithField("message", msg).Warn("Server sent unexpected message")
+				var err error
+				if msg.Error != nil {
+					err = msg.Error
 				}
-			} else {
-				// Current Meteor server sends an undocumented DDP message
-				// (looks like clustering "hint"). We will register and
-				// ignore rather than log an error.
-				serverID, ok := msg["server_id"]
+				// The removals for the subscription may be buffered
+				c.whenResynced(func() { sub.markStopped(err) })
+			}
+			c.settleResync([]string{msg.ID}, nil)
+		case *ReadyMessage:
+			// Run 'done' callbacks on all ready subscriptions
+			for _, id := range msg.Subs {
+				c.lock.Lock()
+				sub, ok := c.subs[id]
+				if ok {
+					sub.loaded = true
+				}
+				c.lock.Unlock()
 				if ok {
-					switch ID := serverID.(type) {
-					case string:
-						c.serverID = ID
-					default:
-						log.WithField("server_id", serverID).Warn("Server cluster node")
-					}
+					c.whenResynced(sub.complete)
+				}
+			}
+			c.settleResync(msg.Subs, nil)
+		case *AddedMessage, *ChangedMessage, *RemovedMessage, *AddedBeforeMessage, *MovedBeforeMessage:
+			c.attribute(event)
+			if !c.bufferResync(event) {
+				applyData(event, c.CollectionByNameWithDefault)
+			}
+
+		// RPC
+		case *ResultMessage:
+			c.lock.Lock()
+			call := c.calls[msg.ID]
+			delete(c.calls, msg.ID)
+			c.lock.Unlock()
+			if call != nil {
+				if msg.Error != nil {
+					call.Error = msg.Error
+				} else if call.into != nil {
+					call.Reply = call.into
+					call.Error = decodeEJSON(msg.Result, call.into)
 				} else {
-					log.WithField("message", msg).Warn("Server sent message with no `msg` field")
+					call.Reply = msg.Result
+				}
+				call.done()
+			}
+		case *UpdatedMessage:
+			// The writes made by these methods are now visible in
+			// our collections
+			for _, id := range msg.Methods {
+				c.lock.Lock()
+				call, ok := c.updates[id]
+				delete(c.updates, id)
+				c.lock.Unlock()
+				if ok {
+					c.whenResynced(call.markUpdated)
 				}
 			}
-		case err := <-c.errors:
-			log.WithField("target", c.url).WithField("origin", c.origin).WithError(err).Error("Websocket error")
+			c.settleResync(nil, msg.Methods)
+
+		default:
+			// Ignore?
+			log.WithField("message", event.raw).Warn("Server sent unexpected message")
 		}
 	}
 }
 
-func (c *Client) collectionBy(msg map[string]interface{}) Collection {
-	n, ok := msg["collection"]
-	if !ok {
-		return NewMockCollection()
-	}
-	switch name := n.(type) {
-	case string:
-		return c.CollectionByName(name)
+// applyData applies a livedata message to the collection that get returns
+// for it, creating it with makeDefault if needed.
+func applyData(event *inboxEvent, get func(name string, makeDefault func(string) Collection) Collection) {
+	var collection Collection
+	switch msg := event.msg.(type) {
+	case *AddedMessage:
+		collection = get(msg.Collection, NewCollection)
+	case *ChangedMessage:
+		collection = get(msg.Collection, NewCollection)
+	case *RemovedMessage:
+		collection = get(msg.Collection, NewCollection)
+	case *AddedBeforeMessage:
+		// Collections first seen in order keep it
+		collection = get(msg.Collection, NewOrderedCollection)
+	case *MovedBeforeMessage:
+		collection = get(msg.Collection, NewCollection)
 	default:
-		return NewMockCollection()
+		return
+	}
+	raw := event.raw
+	if box, ok := collection.(merger); ok && event.merge {
+		if raw = box.merge(raw, event.owners); raw == nil {
+			return
+		}
 	}
+	applyMessage(collection, raw)
 }
 
-// inboxWorker pulls messages from a websocket, decodes JSON packets, and
-// stuffs them into a message channel.
-func (c *Client) inboxWorker(ws *websocket.Conn) {
-	context := log.WithField("reconnects", c.reconnects).WithField("target", c.url).WithField("source", c.origin)
-	for {
-		var event interface{}
+// applyMessage sends a livedata message to the collection method for its
+// type.
+func applyMessage(collection Collection, msg map[string]interface{}) {
+	switch msg["msg"] {
+	case "added":
+		collection.Added(msg)
+	case "changed":
+		collection.Changed(msg)
+	case "removed":
+		collection.Removed(msg)
+	case "addedBefore":
+		collection.AddedBefore(msg)
+	case "movedBefore":
+		collection.MovedBefore(msg)
+	}
+}
+
+// attribute credits a data message to subscriptions when the client merges
+// them. Removals go to the subscriptions being stopped. Anything else goes
+// to the earliest subscription still waiting for its initial data - the
+// server sends each subscription's data in turn - or else to no one, as
+// there is no telling which ready subscription sent it.
+func (c *Client) attribute(event *inboxEvent) {
+	if !c.mergeBox {
+		return
+	}
+	event.merge = true
+	_, removal := event.msg.(*RemovedMessage)
+	var stopping, waiting []string
+	c.lock.Lock()
+	for id, sub := range c.subs {
+		switch {
+		case sub.stopping:
+			stopping = append(stopping, id)
+		case !sub.loaded:
+			waiting = append(waiting, id)
+		}
+	}
+	c.lock.Unlock()
+	switch {
+	case removal:
+		sort.Strings(stopping)
+		event.owners = stopping
+	case len(waiting) > 0:
+		sortIDs(waiting)
+		event.owners = waiting[:1]
+	}
+}
 
-		if err := websocket.JSON.Receive(ws, &event); err != nil {
-			if err != io.EOF {
-				c.errors <- err
+// release drops the data only the subscription published from every
+// collection.
+func (c *Client) release(sub string) {
+	c.lock.Lock()
+	collections := make([]Collection, 0, len(c.collections))
+	for _, collection := range c.collections {
+		collections = append(collections, collection)
+	}
+	c.lock.Unlock()
+	for _, collection := range collections {
+		if box, ok := collection.(merger); ok {
+			for _, msg := range box.release(sub) {
+				applyMessage(collection, msg)
 			}
-			break
 		}
-		if c.pingTimer != nil {
-			c.pingTimer.Reset(c.HeartbeatInterval)
+	}
+}
+
+// inboxWorker pulls messages from a transport, decodes JSON packets, and
+// stuffs them into a message channel. Frames that aren't valid DDP
+// messages are answered with an error message and skipped.
+func (c *Client) inboxWorker(conn *connection) {
+	context := log.WithField("reconnects", atomic.LoadInt64(&c.reconnects)).WithField("target", c.url).WithField("source", c.origin)
+	for {
+		data, err := conn.transport.ReadMessage()
+		if err != nil {
+			// Let the inbox manager handle the end of the connection
+			// after any messages that are still queued
+			c.queue(&inboxEvent{conn: conn, err: err})
+			return
+		}
+		c.resetPingTimer()
+		if len(data) == 0 {
+			// A transport heartbeat - the server is alive
+			continue
+		}
+		msg, raw, err := decodeMessage(data)
+		if err != nil {
+			context.WithField("frame", string(data)).WithError(err).Warn("Server sent a bad message")
+			var offending interface{}
+			if raw != nil {
+				offending = raw
+			}
+			conn.send(NewErrorMessage(err.Error(), offending))
+			continue
 		}
-		if event == nil {
-			context.Warn("Inbox worker found nil event.  Unclear why, as an error should have been triggered.")
-		} else {
-			c.inbox <- event.(map[string]interface{})
+		if !c.queue(&inboxEvent{conn: conn, msg: msg, raw: raw}) {
+			return
 		}
 	}
+}
+
+// queue hands an event to the inboxManager, giving up if the connection is
+// closed in the meantime - the client may have stopped listening.
+func (c *Client) queue(event *inboxEvent) bool {
+	select {
+	case c.inbox <- event:
+		return true
+	case <-event.conn.closed:
+		return false
+	}
+}
 
-	c.Close()
+// startInbox starts the inboxManager unless it is already running.
+func (c *Client) startInbox() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+		go c.inboxManager(c.done)
+	}
+}
 
-	// Spawn a reconnect
-	time.AfterFunc(c.ReconnectInterval, c.Reconnect)
+// disconnected handles the end of a connection, spawning a reconnect
+// unless the connection was closed on purpose.
+func (c *Client) disconnected(conn *connection, err error) {
+	if !c.dropConnection(conn) {
+		return
+	}
+	if err != io.EOF {
+		log.WithField("target", c.url).WithField("origin", c.origin).WithError(err).Error("Websocket error")
+	}
+	c.setState(Waiting, err)
+	c.startReconnectLoop()
+}
+
+// inboxEvent is a message received on a connection. A nil msg marks the
+// end of the connection with err holding the read error.
+type inboxEvent struct {
+	conn *connection
+	// msg is the typed message and raw the generic decoded object.
+	msg interface{}
+	raw map[string]interface{}
+	err error
+	// owners are the subscriptions a data message is credited to when
+	// merge is set.
+	owners []string
+	merge  bool
+}
+
+// -------------------------------------------------------------------
+
+// connection holds the state of a single transport connection. Messages
+// are written by a single outboxWorker goroutine so concurrent senders
+// never interleave frames on the socket.
+type connection struct {
+	transport Transport
+	// outbox queues messages for the outboxWorker
+	outbox chan *outgoing
+	// closed is closed when the connection shuts down
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// outgoing is a message waiting to be written along with a channel for
+// the result of the write.
+type outgoing struct {
+	msg    interface{}
+	result chan error
+}
+
+// newConnection creates a connection for the transport.
+func newConnection(transport Transport) *connection {
+	return &connection{
+		transport: transport,
+		outbox:    make(chan *outgoing),
+		closed:    make(chan struct{}),
+	}
+}
+
+// send queues a message for writing and waits for the write to finish.
+func (conn *connection) send(msg interface{}) error {
+	out := &outgoing{msg: msg, result: make(chan error, 1)}
+	select {
+	case conn.outbox <- out:
+	case <-conn.closed:
+		return fmt.Errorf("Tried to send message on a closed socket")
+	}
+	select {
+	case err := <-out.result:
+		return err
+	case <-conn.closed:
+		return fmt.Errorf("Socket closed while sending message")
+	}
+}
+
+// outboxWorker writes queued messages to the socket until the connection
+// is closed.
+func (conn *connection) outboxWorker() {
+	for {
+		select {
+		case out := <-conn.outbox:
+			data, err := json.Marshal(out.msg)
+			if err == nil {
+				err = conn.transport.WriteMessage(data)
+			}
+			out.result <- err
+		case <-conn.closed:
+			return
+		}
+	}
+}
+
+// close shuts down the connection, returning true if this call closed it.
+func (conn *connection) close() bool {
+	closed := false
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.transport.Close()
+		closed = true
+	})
+	return closed
+}
+
+// isClosed returns true once the connection has been closed.
+func (conn *connection) isClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
 }
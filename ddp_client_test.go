@@ -0,0 +1,578 @@
+package ddp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"golang.org/x/net/websocket"
+)
+
+// testServer is a minimal DDP server for exercising the client. Every
+// message the server receives is passed to handler along with a function
+// to send replies on the same connection.
+type testServer struct {
+	*httptest.Server
+	handler func(msg map[string]interface{}, send func(interface{}))
+	// version is the only DDP version the server accepts
+	version string
+
+	lock     sync.Mutex
+	received []map[string]interface{}
+	headers  []http.Header
+	conns    map[*websocket.Conn]bool
+}
+
+// newTestServer starts a server that completes the DDP handshake, answers
+// pings and hands all other messages to handler (which may be nil).
+func newTestServer(handler func(msg map[string]interface{}, send func(interface{}))) *testServer {
+	return newTestServerVersion("1", handler)
+}
+
+// newTestServerVersion starts a test server that only speaks the given DDP
+// version.
+func newTestServerVersion(version string, handler func(msg map[string]interface{}, send func(interface{}))) *testServer {
+	s := &testServer{handler: handler, version: version, conns: map[*websocket.Conn]bool{}}
+	s.Server = httptest.NewServer(websocket.Handler(s.serve))
+	return s
+}
+
+// newTLSTestServer starts a test server that only accepts wss://
+// connections.
+func newTLSTestServer(handler func(msg map[string]interface{}, send func(interface{}))) *testServer {
+	s := &testServer{handler: handler, version: "1", conns: map[*websocket.Conn]bool{}}
+	s.Server = httptest.NewTLSServer(websocket.Handler(s.serve))
+	return s
+}
+
+// URL returns the websocket URL for the server.
+func (s *testServer) URL() string {
+	return "ws" + strings.TrimPrefix(s.Server.URL, "http") + "/websocket"
+}
+
+// Received returns the messages the server has seen with the given type.
+func (s *testServer) Received(msgType string) []map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	found := []map[string]interface{}{}
+	for _, msg := range s.received {
+		if msg["msg"] == msgType {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
+
+// Headers returns the HTTP headers of each websocket handshake the server
+// has accepted.
+func (s *testServer) Headers() []http.Header {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]http.Header{}, s.headers...)
+}
+
+// Drop closes all open connections to the server.
+func (s *testServer) Drop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for ws := range s.conns {
+		ws.Close()
+	}
+}
+
+// Shutdown stops accepting connections and drops the open ones.
+func (s *testServer) Shutdown() {
+	s.Listener.Close()
+	s.Drop()
+}
+
+func (s *testServer) serve(ws *websocket.Conn) {
+	s.lock.Lock()
+	s.conns[ws] = true
+	s.headers = append(s.headers, ws.Request().Header)
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, ws)
+		s.lock.Unlock()
+	}()
+	var sendLock sync.Mutex
+	send := func(msg interface{}) {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		websocket.JSON.Send(ws, msg)
+	}
+	for {
+		var msg map[string]interface{}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.received = append(s.received, msg)
+		s.lock.Unlock()
+		switch msg["msg"] {
+		case "connect":
+			if msg["version"] != s.version {
+				send(map[string]interface{}{"msg": "failed", "version": s.version})
+				return
+			}
+			send(map[string]interface{}{"msg": "connected", "session": "test-session"})
+		case "ping":
+			send(map[string]interface{}{"msg": "pong", "id": msg["id"]})
+		default:
+			if s.handler != nil {
+				s.handler(msg, send)
+			}
+		}
+	}
+}
+
+var _ = Describe("Client", func() {
+
+	var server *testServer
+	var client *Client
+
+	BeforeEach(func() {
+		server = newTestServer(func(msg map[string]interface{}, send func(interface{})) {
+			switch msg["msg"] {
+			case "method":
+				switch msg["method"] {
+				case "forbidden":
+					send(map[string]interface{}{"msg": "result", "id": msg["id"], "error": map[string]interface{}{
+						"error":     403,
+						"reason":    "Access denied",
+						"message":   "Access denied [403]",
+						"errorType": "Meteor.Error",
+						"details":   map[string]interface{}{"user": "nobody"},
+					}})
+				case "build":
+					send(map[string]interface{}{"msg": "result", "id": msg["id"], "result": map[string]interface{}{
+						"name":    "nightly",
+						"created": map[string]interface{}{"$date": 1136214245000},
+						"log":     map[string]interface{}{"$binary": "aGVsbG8="},
+						"tags":    []interface{}{"go", "ddp"},
+						"env":     map[string]interface{}{"$escape": map[string]interface{}{"$date": "not a date"}},
+					}})
+				case "mutate":
+					// Result first, then the data, then the write fence
+					send(map[string]interface{}{"msg": "result", "id": msg["id"], "result": "ok"})
+					send(map[string]interface{}{"msg": "added", "collection": "builds", "id": msg["id"], "fields": map[string]interface{}{"name": "mutated"}})
+					send(map[string]interface{}{"msg": "updated", "methods": []string{msg["id"].(string)}})
+				case "fenced":
+					// Write fence before the result
+					send(map[string]interface{}{"msg": "updated", "methods": []string{msg["id"].(string)}})
+					send(map[string]interface{}{"msg": "result", "id": msg["id"], "result": "ok"})
+				case "nothing":
+					send(map[string]interface{}{"msg": "result", "id": msg["id"]})
+				case "slow":
+					// Never answer
+				case "throttled":
+					send(map[string]interface{}{"msg": "result", "id": msg["id"], "error": map[string]interface{}{
+						"error":     "too-many-requests",
+						"reason":    "Error, too many requests. Please slow down.",
+						"errorType": "Meteor.Error",
+						"details":   map[string]interface{}{"timeToReset": 1000},
+					}})
+				default:
+					send(map[string]interface{}{"msg": "result", "id": msg["id"], "result": msg["params"]})
+				}
+			case "sub":
+				if msg["name"] == "slow" {
+					return
+				}
+				if msg["name"] == "missing" {
+					send(map[string]interface{}{"msg": "nosub", "id": msg["id"], "error": map[string]interface{}{
+						"error":     404,
+						"reason":    "Subscription 'missing' not found",
+						"message":   "Subscription 'missing' not found [404]",
+						"errorType": "Meteor.Error",
+					}})
+					return
+				}
+				send(map[string]interface{}{"msg": "added", "collection": "builds", "id": msg["id"], "fields": map[string]interface{}{"name": msg["name"]}})
+				send(map[string]interface{}{"msg": "ready", "subs": []string{msg["id"].(string)}})
+			case "unsub":
+				send(map[string]interface{}{"msg": "removed", "collection": "builds", "id": msg["id"]})
+				send(map[string]interface{}{"msg": "nosub", "id": msg["id"]})
+			}
+		})
+		var err error
+		client, err = NewClient(server.URL(), "http://localhost/")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	Describe("Stats", func() {
+
+		It("should count reads and writes", func() {
+			_, err := client.Call("echo", []interface{}{"hello"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			stats := client.Stats()
+			Ω(stats.Writes.Ops).Should(BeNumerically(">=", 2))
+			Ω(stats.Writes.Bytes).Should(BeNumerically(">", 0))
+			Ω(stats.Reads.Bytes).Should(BeNumerically(">", 0))
+			Ω(stats.TotalWrites.Bytes).Should(Equal(stats.Writes.Bytes))
+			Ω(stats.TotalReads.Bytes).Should(Equal(stats.Reads.Bytes))
+			Ω(stats.Reads.Errors).Should(BeZero())
+		})
+
+		It("should not count reads cut short by the client as errors", func() {
+			client.Reconnect()
+			Eventually(client.Session).ShouldNot(BeEmpty())
+			_, err := client.Call("echo", []interface{}{"hello"})
+			Ω(err).ShouldNot(HaveOccurred())
+			client.Close()
+			Consistently(func() int64 { return client.Stats().TotalReads.Errors }, 100*time.Millisecond).Should(BeZero())
+		})
+
+		It("should count pings sent", func() {
+			done := make(chan error, 1)
+			client.PingPong("stats", client.HeartbeatTimeout, func(err error) { done <- err })
+			Eventually(done).Should(Receive(BeNil()))
+			Ω(client.Stats().PingsSent).Should(Equal(int64(1)))
+		})
+
+		It("should reset", func() {
+			_, err := client.Call("echo", []interface{}{"hello"})
+			Ω(err).ShouldNot(HaveOccurred())
+			client.ResetStats()
+
+			stats := client.Stats()
+			Ω(stats.Writes.Bytes).Should(BeZero())
+			Ω(stats.TotalWrites.Bytes).Should(BeZero())
+			Ω(stats.TotalReads.Ops).Should(BeZero())
+			Ω(stats.Reconnects).Should(BeZero())
+		})
+	})
+
+	Describe("Call", func() {
+
+		It("should return results", func() {
+			reply, err := client.Call("echo", []interface{}{"hello"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(reply).Should(Equal([]interface{}{"hello"}))
+		})
+
+		It("should return numeric error codes", func() {
+			_, err := client.Call("forbidden", []interface{}{})
+			var e *Error
+			Ω(errors.As(err, &e)).Should(BeTrue())
+			Ω(e.Code).Should(Equal("403"))
+			Ω(e.Reason).Should(Equal("Access denied"))
+			Ω(e.Details).Should(HaveKeyWithValue("user", "nobody"))
+			Ω(err.Error()).Should(Equal("Access denied [403]"))
+		})
+
+		It("should return string error codes", func() {
+			_, err := client.Call("throttled", []interface{}{})
+			var e *Error
+			Ω(errors.As(fmt.Errorf("wrapped: %w", err), &e)).Should(BeTrue())
+			Ω(e.Code).Should(Equal("too-many-requests"))
+			Ω(e.ErrorType).Should(Equal("Meteor.Error"))
+			Ω(err.Error()).Should(Equal("Error, too many requests. Please slow down. [too-many-requests]"))
+		})
+
+		It("should end calls in flight when the client closes", func() {
+			call := client.Go("slow", []interface{}{}, nil)
+			Eventually(func() []map[string]interface{} { return server.Received("method") }).Should(HaveLen(1))
+			client.Close()
+			Eventually(call.Done).Should(Receive())
+			Ω(call.Error).Should(HaveOccurred())
+			Ω(call.Updated()).Should(BeClosed())
+		})
+
+		It("should fail calls on a closed client at once", func() {
+			client.Close()
+			call := client.Go("echo", []interface{}{"hello"}, nil)
+			Eventually(call.Done).Should(Receive())
+			Ω(call.Error).Should(HaveOccurred())
+			_, err := client.CallAndWaitForData(context.Background(), "echo")
+			Ω(err).Should(HaveOccurred())
+			Ω(server.Received("method")).Should(BeEmpty())
+		})
+	})
+
+	Describe("Context", func() {
+
+		It("should call with a context", func() {
+			reply, err := client.CallContext(context.Background(), "echo", "hello", "world")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(reply).Should(Equal([]interface{}{"hello", "world"}))
+		})
+
+		It("should send empty params", func() {
+			reply, err := client.CallContext(context.Background(), "echo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(reply).Should(Equal([]interface{}{}))
+		})
+
+		It("should stop waiting for a call when cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := client.CallContext(ctx, "slow")
+			Ω(err).Should(Equal(context.DeadlineExceeded))
+		})
+
+		It("should subscribe with a context", func() {
+			sub, err := client.SubContext(context.Background(), "builds")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(sub.Ready()).Should(BeClosed())
+		})
+
+		It("should return subscription errors", func() {
+			_, err := client.SubContext(context.Background(), "missing")
+			Ω(err).Should(BeAssignableToTypeOf(&Error{}))
+		})
+
+		It("should unsub when cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				Eventually(func() int { return len(server.Received("sub")) }).Should(Equal(1))
+				cancel()
+			}()
+			_, err := client.SubContext(ctx, "slow")
+			Ω(err).Should(Equal(context.Canceled))
+			Eventually(func() []map[string]interface{} { return server.Received("unsub") }).Should(HaveLen(1))
+			Ω(server.Received("unsub")[0]["id"]).Should(Equal(server.Received("sub")[0]["id"]))
+		})
+	})
+
+	Describe("Updated", func() {
+
+		It("should wait for data", func() {
+			reply, err := client.CallAndWaitForData(context.Background(), "mutate")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(reply).Should(Equal("ok"))
+			id := server.Received("method")[0]["id"].(string)
+			Ω(client.CollectionByName("builds").FindOne(id)).Should(HaveKeyWithValue("name", "mutated"))
+		})
+
+		It("should handle updated before the result", func() {
+			call := <-client.Go("fenced", []interface{}{}, nil).Done
+			Ω(call.Updated()).Should(BeClosed())
+			Ω(call.Reply).Should(Equal("ok"))
+		})
+
+		It("should record updated after the result", func() {
+			call := client.Go("mutate", []interface{}{}, nil)
+			Eventually(call.Done).Should(Receive())
+			Eventually(call.Updated()).Should(BeClosed())
+		})
+
+		It("should stop waiting when cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := client.CallAndWaitForData(ctx, "echo")
+			Ω(err).Should(Equal(context.DeadlineExceeded))
+		})
+	})
+
+	Describe("Typed results", func() {
+
+		type build struct {
+			Name    string            `json:"name"`
+			Created time.Time         `json:"created"`
+			Log     []byte            `json:"log"`
+			Tags    []string          `json:"tags"`
+			Env     map[string]string `json:"env"`
+		}
+
+		It("should decode into a struct", func() {
+			var b build
+			Ω(client.CallInto(context.Background(), &b, "build")).Should(Succeed())
+			Ω(b.Name).Should(Equal("nightly"))
+			Ω(b.Created.Equal(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC))).Should(BeTrue())
+			Ω(string(b.Log)).Should(Equal("hello"))
+			Ω(b.Tags).Should(Equal([]string{"go", "ddp"}))
+			Ω(b.Env).Should(Equal(map[string]string{"$date": "not a date"}))
+		})
+
+		It("should decode into slices and maps", func() {
+			var strs []string
+			Ω(client.CallInto(context.Background(), &strs, "echo", "a", "b")).Should(Succeed())
+			Ω(strs).Should(Equal([]string{"a", "b"}))
+
+			var m map[string]interface{}
+			Ω(client.CallInto(context.Background(), &m, "build")).Should(Succeed())
+			Ω(m).Should(HaveKeyWithValue("created", "2006-01-02T15:04:05Z"))
+		})
+
+		It("should leave the reply untouched for empty results", func() {
+			out := "unchanged"
+			Ω(client.CallInto(context.Background(), &out, "nothing")).Should(Succeed())
+			Ω(out).Should(Equal("unchanged"))
+		})
+
+		It("should report decode errors", func() {
+			var n int
+			Ω(client.CallInto(context.Background(), &n, "build")).ShouldNot(Succeed())
+		})
+
+		It("should decode asynchronously", func() {
+			var b build
+			call := <-client.GoInto("build", []interface{}{}, &b, nil).Done
+			Ω(call.Error).ShouldNot(HaveOccurred())
+			Ω(call.Reply).Should(Equal(&b))
+			Ω(b.Name).Should(Equal("nightly"))
+		})
+	})
+
+	Describe("Subscription", func() {
+
+		It("should become ready", func() {
+			sub := client.Subscribe("builds", []interface{}{}, nil)
+			Eventually(sub.Ready()).Should(BeClosed())
+			Ω(sub.Err()).ShouldNot(HaveOccurred())
+			Ω(client.CollectionByName("builds").FindOne(sub.ID)).ShouldNot(BeNil())
+		})
+
+		It("should stop with unsub", func() {
+			sub := client.Subscribe("builds", []interface{}{}, nil)
+			Eventually(sub.Done).Should(Receive())
+			Ω(sub.Stop()).Should(Succeed())
+
+			unsubs := server.Received("unsub")
+			Ω(unsubs).Should(HaveLen(1))
+			Ω(unsubs[0]["id"]).Should(Equal(sub.ID))
+			Ω(client.CollectionByName("builds").FindOne(sub.ID)).Should(BeNil())
+
+			// Stopping again is a no-op
+			Ω(sub.Stop()).Should(Succeed())
+			Ω(server.Received("unsub")).Should(HaveLen(1))
+		})
+
+		It("should report nosub errors", func() {
+			err := client.Sub("missing", []interface{}{})
+			Ω(err).Should(HaveOccurred())
+			e, ok := err.(*Error)
+			Ω(ok).Should(BeTrue())
+			Ω(e.Code).Should(Equal("404"))
+			Ω(e.Reason).Should(Equal("Subscription 'missing' not found"))
+			Ω(e.ErrorType).Should(Equal("Meteor.Error"))
+			Ω(e.Error()).Should(Equal("Subscription 'missing' not found [404]"))
+		})
+
+		It("should complete failed subscriptions", func() {
+			sub := client.Subscribe("missing", []interface{}{}, nil)
+			Eventually(sub.Ready()).Should(BeClosed())
+			Ω(sub.Err()).Should(HaveOccurred())
+			Ω(sub.Stop()).Should(Succeed())
+			Ω(server.Received("unsub")).Should(BeEmpty())
+		})
+
+		It("should fail subscriptions on a closed client at once", func() {
+			client.Close()
+			sub := client.Subscribe("builds", []interface{}{}, nil)
+			Eventually(sub.Ready()).Should(BeClosed())
+			Ω(sub.Err()).Should(HaveOccurred())
+			Ω(server.Received("sub")).Should(BeEmpty())
+		})
+	})
+
+	Describe("Concurrency", func() {
+
+		It("should allow concurrent calls", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					reply, err := client.Call("echo", []interface{}{float64(i)})
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(reply).Should(Equal([]interface{}{float64(i)}))
+				}(i)
+			}
+			wg.Wait()
+		})
+
+		It("should allow concurrent subscriptions and queries", func() {
+			builds := client.CollectionByName("builds")
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(2)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					sub := client.Subscribe("builds", []interface{}{}, nil)
+					Eventually(sub.Ready()).Should(BeClosed())
+					Ω(sub.Stop()).Should(Succeed())
+				}()
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for id := range builds.FindAll() {
+						builds.FindOne(id)
+					}
+					client.Stats()
+					client.Session()
+				}()
+			}
+			wg.Wait()
+			Ω(builds.FindAll()).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("DialContext", func() {
+
+	It("should return a connected client", func() {
+		server := newTestServer(nil)
+		defer server.Close()
+		client, err := DialContext(context.Background(), server.URL())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(client.Status().State).Should(Equal(Connected))
+		Ω(client.Session()).Should(Equal("test-session"))
+	})
+
+	It("should time out when the server never completes the handshake", func() {
+		// Accepts the websocket but never answers connect
+		server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+			io.Copy(io.Discard, ws)
+		}))
+		defer server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		client, err := DialContext(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+		Ω(client).Should(BeNil())
+		Ω(err).Should(MatchError(context.DeadlineExceeded))
+		Ω(err.Error()).Should(ContainSubstring("handshake"))
+	})
+
+	It("should not leak goroutines when dialing fails", func() {
+		server := newTestServerVersion("2", nil)
+		defer server.Close()
+		before := runtime.NumGoroutine()
+		for i := 0; i < 20; i++ {
+			_, err := DialContext(context.Background(), server.URL())
+			Ω(err).Should(HaveOccurred())
+		}
+		Eventually(runtime.NumGoroutine, 2*time.Second).Should(BeNumerically("<=", before+2))
+	})
+
+	It("should fail when the server can't be reached", func() {
+		server := httptest.NewServer(nil)
+		url := "ws" + strings.TrimPrefix(server.URL, "http")
+		server.Close()
+		_, err := DialContext(context.Background(), url)
+		Ω(err).Should(HaveOccurred())
+	})
+})
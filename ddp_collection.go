@@ -2,6 +2,7 @@ package ddp
 
 import (
 	"fmt"
+	"sync"
 )
 
 // ----------------------------------------------------------------------
@@ -124,15 +125,17 @@ func (d *Doc) Split(path []string) (dir []string, file string, err error) {
 // Collection managed cached collection data sent from the server in a
 // livedata subscription.
 //
-// It would be great to build an entire mongo compatible local store (minimongo)
+// The built in collections are safe for concurrent use by multiple
+// goroutines - the client applies updates while callers query.
 type Collection interface {
 
 	// FindOne queries objects and returns the first match.
 	FindOne(id string) interface{}
-	// FindAll returns a map of all items in the cache - this is a hack
-	// until we have time to build out a real minimongo interface.
+	// FindAll returns a map of all items in the cache.
 	FindAll() map[string]interface{}
 	// AddUpdateListener adds a channel that receives update messages.
+	//
+	// Deprecated: use AddChangeListener.
 	AddUpdateListener(chan<- map[string]interface{})
 
 	// livedata updates
@@ -147,6 +150,22 @@ type Collection interface {
 	Reset()
 }
 
+// ChangeNotifier is implemented by collections that send an event for every
+// change, as the built in collections do.
+type ChangeNotifier interface {
+	// AddChangeListener adds a channel that receives an event for every
+	// change to the collection.
+	AddChangeListener(chan<- ChangeEvent)
+	// RemoveChangeListener stops sending events to the channel.
+	RemoveChangeListener(chan<- ChangeEvent)
+}
+
+// consistencyReporter is implemented by collections that report messages
+// about unknown documents.
+type consistencyReporter interface {
+	OnConsistencyError(handler func(*ConsistencyError))
+}
+
 // NewMockCollection creates an empty collection that does nothing.
 func NewMockCollection() Collection {
 	return &MockCache{}
@@ -154,7 +173,65 @@ func NewMockCollection() Collection {
 
 // NewCollection creates a new collection - always KeyCache.
 func NewCollection(name string) Collection {
-	return &KeyCache{name, map[string]interface{}{}, nil}
+	return &KeyCache{Name: name, items: map[string]interface{}{}}
+}
+
+// ChangeKind identifies the kind of change to a collection.
+type ChangeKind int
+
+const (
+	// Added means a document was added.
+	Added ChangeKind = iota
+	// Changed means fields of a document were set or cleared.
+	Changed
+	// Removed means a document was removed.
+	Removed
+	// Moved means a document moved within an ordered collection.
+	Moved
+	// Reset means every document was removed, usually on reconnect.
+	Reset
+)
+
+// String returns the name of the change kind.
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Changed:
+		return "changed"
+	case Removed:
+		return "removed"
+	case Moved:
+		return "moved"
+	case Reset:
+		return "reset"
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeEvent describes a single change to a collection. Documents are
+// snapshots - they are never modified after the event is sent, so
+// listeners may keep them.
+type ChangeEvent struct {
+	// Kind is the kind of change.
+	Kind ChangeKind
+	// Collection is the name of the collection.
+	Collection string
+	// ID is the id of the document. It is empty for Reset.
+	ID string
+	// Fields holds the fields that were set: the whole document for Added
+	// and the changed fields for Changed.
+	Fields map[string]interface{}
+	// Cleared lists the fields removed by a Changed event.
+	Cleared []string
+	// BeforeID is the id of the document a Moved (or ordered Added)
+	// document now precedes, or empty for the end of the collection.
+	BeforeID string
+	// Before is the document before the change, nil for Added and Reset.
+	Before map[string]interface{}
+	// After is the document after the change, nil for Removed and Reset.
+	After map[string]interface{}
 }
 
 // KeyCache caches items keyed on unique ID.
@@ -163,64 +240,140 @@ type KeyCache struct {
 	Name string
 	// items contains collection items by ID
 	items map[string]interface{}
-	// listeners contains all the listeners that should be notified of collection updates.
-	listeners []chan<- map[string]interface{}
-	// TODO(badslug): do we need to protect from multiple threads
+	// watchers are sent a ChangeEvent for every change.
+	watchers []*Watcher
+	// listeners holds the watchers forwarding to each listener channel.
+	listeners map[interface{}][]*Watcher
+	// consistencyHandlers are notified of messages about unknown documents.
+	consistencyHandlers []func(*ConsistencyError)
+	// merged tracks the subscriptions behind each document, see merger.
+	merged map[string]*mergedDoc
+	// lock protects items and watchers. Stored items are never modified
+	// in place so they can be handed out without holding the lock.
+	lock sync.RWMutex
 }
 
 func (c *KeyCache) Added(msg map[string]interface{}) {
 	context := log.WithField("message", msg).WithField("collection", c.Name)
 	context.Debug("Added")
 	id := idForMessage(msg)
-	c.items[id] = msg["fields"]
-	// TODO(badslug): change notification should include change type
-	for _, listener := range c.listeners {
-		context.WithField("listener", listener).Debug("notifying listener")
-		listener <- msg
+	fields, ok := msg["fields"].(map[string]interface{})
+	if !ok {
+		fields = map[string]interface{}{}
 	}
+	c.lock.Lock()
+	before, _ := c.items[id].(map[string]interface{})
+	c.items[id] = fields
+	watchers := c.watchers
+	c.lock.Unlock()
+	c.notify(watchers, ChangeEvent{
+		Kind:   Added,
+		ID:     id,
+		Fields: fields,
+		Before: before,
+		After:  fields,
+	})
 	context.Debug("Added done")
 }
 
+// Changed sets the message's `fields` on the document and deletes the
+// fields listed in `cleared`.
 func (c *KeyCache) Changed(msg map[string]interface{}) {
 	context := log.WithField("message", msg).WithField("collection", c.Name)
 	context.Debug("Changed")
 	id := idForMessage(msg)
+	c.lock.Lock()
 	item, ok := c.items[id]
-	if ok {
-		switch itemFields := item.(type) {
-		case map[string]interface{}:
-			fields, ok := msg["fields"]
-			if ok {
-				switch msgFields := fields.(type) {
-				case map[string]interface{}:
-					for key, value := range msgFields {
-						itemFields[key] = value
-					}
-					c.items[id] = itemFields
-				default:
-					// Don't know what to do...
-				}
-			}
-		default:
-			// Don't know what to do...
-		}
-	} else {
-		c.items[id] = msg["fields"]
+	if !ok {
+		c.lock.Unlock()
+		c.inconsistent(id, "changed")
+		return
+	}
+	itemFields, _ := item.(map[string]interface{})
+	msgFields, _ := msg["fields"].(map[string]interface{})
+	raw, _ := msg["cleared"].([]interface{})
+	updated := make(map[string]interface{}, len(itemFields)+len(msgFields))
+	for key, value := range itemFields {
+		updated[key] = value
 	}
-	for _, listener := range c.listeners {
-		context.WithField("listener", listener).Debug("notifying listener")
-		listener <- msg
+	for key, value := range msgFields {
+		updated[key] = value
+	}
+	var cleared []string
+	for _, key := range raw {
+		if key, ok := key.(string); ok {
+			delete(updated, key)
+			cleared = append(cleared, key)
+		}
 	}
+	c.items[id] = updated
+	watchers := c.watchers
+	c.lock.Unlock()
+	c.notify(watchers, ChangeEvent{
+		Kind:    Changed,
+		ID:      id,
+		Fields:  msgFields,
+		Cleared: cleared,
+		Before:  itemFields,
+		After:   updated,
+	})
 	context.Debug("Changed done")
 }
 
 func (c *KeyCache) Removed(msg map[string]interface{}) {
 	id := idForMessage(msg)
+	c.lock.Lock()
+	item, ok := c.items[id]
 	delete(c.items, id)
+	watchers := c.watchers
+	c.lock.Unlock()
+	if !ok {
+		c.inconsistent(id, "removed")
+		return
+	}
+	before, _ := item.(map[string]interface{})
+	c.notify(watchers, ChangeEvent{Kind: Removed, ID: id, Before: before})
+}
+
+// notify queues a change for the watchers. It never blocks.
+func (c *KeyCache) notify(watchers []*Watcher, event ChangeEvent) {
+	event.Collection = c.Name
+	for _, watcher := range watchers {
+		watcher.push(event)
+	}
 }
 
+// OnConsistencyError registers a function that is called when the server
+// changes or removes a document the cache doesn't have. Without a handler
+// these are logged.
+func (c *KeyCache) OnConsistencyError(handler func(*ConsistencyError)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Copy on write so notifications can range over a snapshot
+	handlers := make([]func(*ConsistencyError), len(c.consistencyHandlers), len(c.consistencyHandlers)+1)
+	copy(handlers, c.consistencyHandlers)
+	c.consistencyHandlers = append(handlers, handler)
+}
+
+// inconsistent reports a message about an unknown document.
+func (c *KeyCache) inconsistent(id, msgType string) {
+	err := &ConsistencyError{Collection: c.Name, ID: id, Type: msgType}
+	c.lock.RLock()
+	handlers := c.consistencyHandlers
+	c.lock.RUnlock()
+	if len(handlers) == 0 {
+		log.WithError(err).Warn("Collection out of sync with the server")
+		return
+	}
+	for _, handler := range handlers {
+		handler(err)
+	}
+}
+
+// AddedBefore adds the document. A keyed cache doesn't keep order, use an
+// OrderedCache for that.
 func (c *KeyCache) AddedBefore(msg map[string]interface{}) {
-	// for keyed cache, ordered commands are a noop
+	c.Added(msg)
 }
 
 func (c *KeyCache) MovedBefore(msg map[string]interface{}) {
@@ -229,68 +382,407 @@ func (c *KeyCache) MovedBefore(msg map[string]interface{}) {
 
 // FindOne returns the item with matching id.
 func (c *KeyCache) FindOne(id string) interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.items[id]
 }
 
-// FindAll returns a dump of all items in the collection
+// FindAll returns a snapshot of all items in the collection
 func (c *KeyCache) FindAll() map[string]interface{} {
-	return c.items
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	items := make(map[string]interface{}, len(c.items))
+	for id, item := range c.items {
+		items[id] = item
+	}
+	return items
+}
+
+// Find returns a cursor over the documents matching selector. opts may be
+// nil.
+func (c *KeyCache) Find(selector Selector, opts *FindOptions) *Cursor {
+	return NewCursor(c, selector, opts)
 }
 
-// AddUpdateListener adds a listener for changes on a collection.
+// AddUpdateListener adds a listener that is sent an added or changed
+// message for every document added or changed. Messages are buffered
+// without limit until the listener receives them, so a listener that
+// falls behind holds on to ever more of them. The listener is sent
+// messages until it is removed with RemoveUpdateListener.
+//
+// Deprecated: the listener only hears about added and changed documents.
+// Use Watch, which bounds the buffer and can be stopped.
 func (c *KeyCache) AddUpdateListener(ch chan<- map[string]interface{}) {
-	c.listeners = append(c.listeners, ch)
+	watcher := c.addListener(ch)
+	go func() {
+		for event := range watcher.Events() {
+			if msg := updateMessage(event); msg != nil {
+				select {
+				case ch <- msg:
+				case <-watcher.done:
+					return
+				}
+			}
+		}
+	}()
+}
+
+// RemoveUpdateListener stops sending messages to a listener added with
+// AddUpdateListener and discards those not yet received.
+func (c *KeyCache) RemoveUpdateListener(ch chan<- map[string]interface{}) {
+	c.removeListener(ch)
+}
+
+// updateMessage rebuilds the livedata message for an added or changed
+// event, or returns nil for other events.
+func updateMessage(event ChangeEvent) map[string]interface{} {
+	switch event.Kind {
+	case Added:
+		msg := map[string]interface{}{"msg": "added", "collection": event.Collection, "id": event.ID, "fields": event.Fields}
+		if event.BeforeID != "" {
+			msg["msg"] = "addedBefore"
+			msg["before"] = event.BeforeID
+		}
+		return msg
+	case Changed:
+		return changedMessage(event.Collection, event.ID, event.Fields, event.Cleared)
+	}
+	return nil
+}
+
+// AddChangeListener adds a listener that is sent an event for every change
+// to the collection. Events are buffered without limit until the listener
+// receives them, so a listener that falls behind holds on to ever more of
+// them. The listener is sent events until it is removed with
+// RemoveChangeListener. Watch bounds the buffer.
+func (c *KeyCache) AddChangeListener(ch chan<- ChangeEvent) {
+	watcher := c.addListener(ch)
+	go func() {
+		for event := range watcher.Events() {
+			select {
+			case ch <- event:
+			case <-watcher.done:
+				return
+			}
+		}
+	}()
+}
+
+// RemoveChangeListener stops sending events to a listener added with
+// AddChangeListener and discards those not yet received.
+func (c *KeyCache) RemoveChangeListener(ch chan<- ChangeEvent) {
+	c.removeListener(ch)
+}
+
+// addListener starts an unbounded watcher for a listener channel.
+func (c *KeyCache) addListener(ch interface{}) *Watcher {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.listeners == nil {
+		c.listeners = map[interface{}][]*Watcher{}
+	}
+	watcher := c.addWatcher(0, DropOldest)
+	c.listeners[ch] = append(c.listeners[ch], watcher)
+	return watcher
+}
+
+// removeListener stops the watchers for a listener channel.
+func (c *KeyCache) removeListener(ch interface{}) {
+	c.lock.Lock()
+	watchers := c.listeners[ch]
+	delete(c.listeners, ch)
+	c.lock.Unlock()
+	for _, watcher := range watchers {
+		watcher.Stop()
+	}
+}
+
+// Watch starts delivering change events to a new watcher. Up to size events
+// are buffered for the watcher (zero means no limit) and policy decides
+// what happens when the buffer is full. The event waiting to be received
+// doesn't count against the buffer. Call Stop on the watcher to unregister
+// it.
+func (c *KeyCache) Watch(size int, policy OverflowPolicy) *Watcher {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.addWatcher(size, policy)
+}
+
+// watchSnapshot starts an unbounded watcher and returns it with a snapshot
+// of the items. The watcher receives every change made after the snapshot.
+// There is no order.
+func (c *KeyCache) watchSnapshot() (*Watcher, []string, map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	items := make(map[string]interface{}, len(c.items))
+	for id, item := range c.items {
+		items[id] = item
+	}
+	return c.addWatcher(0, DropOldest), nil, items
+}
+
+// addWatcher registers a new watcher. The caller must hold the lock.
+func (c *KeyCache) addWatcher(size int, policy OverflowPolicy) *Watcher {
+	watcher := newWatcher(size, policy)
+	watcher.detach = func() { c.unwatch(watcher) }
+	// Copy on write so notifications can range over a snapshot
+	watchers := make([]*Watcher, len(c.watchers), len(c.watchers)+1)
+	copy(watchers, c.watchers)
+	c.watchers = append(watchers, watcher)
+	return watcher
+}
+
+// unwatch unregisters a watcher.
+func (c *KeyCache) unwatch(watcher *Watcher) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	watchers := make([]*Watcher, 0, len(c.watchers))
+	for _, w := range c.watchers {
+		if w != watcher {
+			watchers = append(watchers, w)
+		}
+	}
+	c.watchers = watchers
 }
 
 // Reset state of the cache.
 func (c *KeyCache) Reset() {
+	c.lock.Lock()
 	c.items = map[string]interface{}{}
+	c.resetMerged()
+	watchers := c.watchers
+	c.lock.Unlock()
+	c.notify(watchers, ChangeEvent{Kind: Reset})
 }
 
-// OrderedCache caches items based on list order.
-// This is a placeholder, currently not implemented as the Meteor server
-// does not transmit ordered collections over DDP yet.
+// OrderedCache caches items in the order set by addedBefore and movedBefore
+// messages. Documents added without a position go at the end.
 type OrderedCache struct {
-	// ranks contains ordered collection items for ordered collections
-	items []interface{}
+	KeyCache
+	// order holds the item ids in order. It is protected by the lock.
+	order []string
+}
+
+// NewOrderedCollection creates a new ordered collection. Select it for a
+// collection with Client.CollectionByNameWithDefault.
+func NewOrderedCollection(name string) Collection {
+	return &OrderedCache{KeyCache: KeyCache{Name: name, items: map[string]interface{}{}}}
 }
 
+// Added adds the document at the end of the collection.
 func (c *OrderedCache) Added(msg map[string]interface{}) {
-	// for ordered cache, key commands are a noop
+	c.add(msg, "")
 }
 
-func (c *OrderedCache) Changed(msg map[string]interface{}) {
+// AddedBefore adds the document before the one with id `before`, or at the
+// end if `before` is null.
+func (c *OrderedCache) AddedBefore(msg map[string]interface{}) {
+	before, _ := msg["before"].(string)
+	c.add(msg, before)
+}
 
+// add inserts a document before another, replacing any document with the
+// same id.
+func (c *OrderedCache) add(msg map[string]interface{}, before string) {
+	context := log.WithField("message", msg).WithField("collection", c.Name)
+	context.Debug("Added")
+	id := idForMessage(msg)
+	fields, ok := msg["fields"].(map[string]interface{})
+	if !ok {
+		fields = map[string]interface{}{}
+	}
+	c.lock.Lock()
+	old, _ := c.items[id].(map[string]interface{})
+	c.items[id] = fields
+	var found bool
+	c.order, found = insertBefore(removeID(c.order, id), id, before)
+	watchers := c.watchers
+	c.lock.Unlock()
+	if !found {
+		c.inconsistent(before, "addedBefore")
+		before = ""
+	}
+	c.notify(watchers, ChangeEvent{
+		Kind:     Added,
+		ID:       id,
+		Fields:   fields,
+		BeforeID: before,
+		Before:   old,
+		After:    fields,
+	})
+	context.Debug("Added done")
 }
 
+// MovedBefore moves the document before the one with id `before`, or to
+// the end if `before` is null.
+func (c *OrderedCache) MovedBefore(msg map[string]interface{}) {
+	id := idForMessage(msg)
+	before, _ := msg["before"].(string)
+	c.lock.Lock()
+	item, ok := c.items[id]
+	var found bool
+	if ok {
+		c.order, found = insertBefore(removeID(c.order, id), id, before)
+	}
+	watchers := c.watchers
+	c.lock.Unlock()
+	if !ok {
+		c.inconsistent(id, "movedBefore")
+		return
+	}
+	if !found {
+		c.inconsistent(before, "movedBefore")
+		before = ""
+	}
+	doc, _ := item.(map[string]interface{})
+	c.notify(watchers, ChangeEvent{Kind: Moved, ID: id, BeforeID: before, Before: doc, After: doc})
+}
+
+// Removed removes the document from the collection.
 func (c *OrderedCache) Removed(msg map[string]interface{}) {
+	id := idForMessage(msg)
+	c.lock.Lock()
+	item, ok := c.items[id]
+	delete(c.items, id)
+	c.order = removeID(c.order, id)
+	watchers := c.watchers
+	c.lock.Unlock()
+	if !ok {
+		c.inconsistent(id, "removed")
+		return
+	}
+	before, _ := item.(map[string]interface{})
+	c.notify(watchers, ChangeEvent{Kind: Removed, ID: id, Before: before})
+}
 
+// Reset removes every document.
+func (c *OrderedCache) Reset() {
+	c.lock.Lock()
+	c.items = map[string]interface{}{}
+	c.resetMerged()
+	c.order = nil
+	watchers := c.watchers
+	c.lock.Unlock()
+	c.notify(watchers, ChangeEvent{Kind: Reset})
+}
+
+// Len returns the number of documents.
+func (c *OrderedCache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.order)
+}
+
+// IDs returns the document ids in order.
+func (c *OrderedCache) IDs() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]string{}, c.order...)
+}
+
+// IndexOf returns the position of a document, or -1 if it isn't in the
+// collection.
+func (c *OrderedCache) IndexOf(id string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return indexOf(c.order, id)
+}
+
+// At returns the id and document at a position. It panics if the position
+// is out of range.
+func (c *OrderedCache) At(index int) (string, interface{}) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	id := c.order[index]
+	return id, c.items[id]
+}
+
+// ForEach calls fn for each document in order until it returns false. It
+// iterates over a snapshot so fn may use the collection.
+func (c *OrderedCache) ForEach(fn func(index int, id string, item interface{}) bool) {
+	order, items := c.snapshot()
+	for i, id := range order {
+		if !fn(i, id, items[id]) {
+			return
+		}
+	}
 }
 
-func (c *OrderedCache) AddedBefore(msg map[string]interface{}) {
+// Find returns a cursor over the documents matching selector, in
+// collection order unless sorted. opts may be nil.
+func (c *OrderedCache) Find(selector Selector, opts *FindOptions) *Cursor {
+	return NewCursor(c, selector, opts)
+}
 
+// Watch is like KeyCache.Watch. A document removed and added again while
+// queued keeps both events even with CoalesceByID, as a Changed event
+// can't carry its new position.
+func (c *OrderedCache) Watch(size int, policy OverflowPolicy) *Watcher {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	watcher := c.addWatcher(size, policy)
+	watcher.ordered = true
+	return watcher
 }
 
-func (c *OrderedCache) MovedBefore(msg map[string]interface{}) {
+// snapshot returns the ids in order and the items.
+func (c *OrderedCache) snapshot() ([]string, map[string]interface{}) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.copyItems()
+}
 
+// watchSnapshot starts an unbounded watcher and returns it with a snapshot
+// of the order and items.
+func (c *OrderedCache) watchSnapshot() (*Watcher, []string, map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	order, items := c.copyItems()
+	return c.addWatcher(0, DropOldest), order, items
 }
 
-// FindOne returns the item with matching id.
-func (c *OrderedCache) FindOne(id string) interface{} {
-	return nil
+// copyItems copies the order and items. The caller must hold the lock.
+func (c *OrderedCache) copyItems() ([]string, map[string]interface{}) {
+	items := make(map[string]interface{}, len(c.items))
+	for id, item := range c.items {
+		items[id] = item
+	}
+	return append([]string{}, c.order...), items
 }
 
-// FindAll returns a dump of all items in the collection
-func (c *OrderedCache) FindAll() map[string]interface{} {
-	return map[string]interface{}{}
+// indexOf returns the position of id in order, or -1.
+func indexOf(order []string, id string) int {
+	for i, existing := range order {
+		if existing == id {
+			return i
+		}
+	}
+	return -1
 }
 
-// AddUpdateListener does nothing.
-func (c *OrderedCache) AddUpdateListener(ch chan<- map[string]interface{}) {
+// removeID removes id from order, if present.
+func removeID(order []string, id string) []string {
+	if i := indexOf(order, id); i >= 0 {
+		return append(order[:i], order[i+1:]...)
+	}
+	return order
 }
 
-// Reset does nothing.
-func (c *OrderedCache) Reset() {
+// insertBefore inserts id into order before the id before, or at the end
+// if before is empty. It reports false, and appends id, if before isn't in
+// order.
+func insertBefore(order []string, id, before string) ([]string, bool) {
+	if before == "" {
+		return append(order, id), true
+	}
+	i := indexOf(order, before)
+	if i < 0 {
+		return append(order, id), false
+	}
+	order = append(order, "")
+	copy(order[i+1:], order[i:])
+	order[i] = id
+	return order, true
 }
 
 // MockCache implements the Collection interface but does nothing with the data.
@@ -327,10 +819,32 @@ func (c *MockCache) FindAll() map[string]interface{} {
 	return map[string]interface{}{}
 }
 
+// Find returns a cursor with no documents.
+func (c *MockCache) Find(selector Selector, opts *FindOptions) *Cursor {
+	return NewCursor(c, selector, opts)
+}
+
 // AddUpdateListener does nothing.
 func (c *MockCache) AddUpdateListener(ch chan<- map[string]interface{}) {
 }
 
+// RemoveUpdateListener does nothing.
+func (c *MockCache) RemoveUpdateListener(ch chan<- map[string]interface{}) {
+}
+
+// AddChangeListener does nothing.
+func (c *MockCache) AddChangeListener(ch chan<- ChangeEvent) {
+}
+
+// RemoveChangeListener does nothing.
+func (c *MockCache) RemoveChangeListener(ch chan<- ChangeEvent) {
+}
+
+// Watch returns a watcher that never receives events.
+func (c *MockCache) Watch(size int, policy OverflowPolicy) *Watcher {
+	return newWatcher(size, policy)
+}
+
 // Reset does nothing.
 func (c *MockCache) Reset() {
 }
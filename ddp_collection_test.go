@@ -0,0 +1,403 @@
+package ddp_test
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KeyCache", func() {
+
+	var collection Collection
+	var inconsistencies []*ConsistencyError
+
+	BeforeEach(func() {
+		collection = NewCollection("builds")
+		inconsistencies = nil
+		collection.(*KeyCache).OnConsistencyError(func(err *ConsistencyError) {
+			inconsistencies = append(inconsistencies, err)
+		})
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "a", "fields": map[string]interface{}{
+			"name":   "nightly",
+			"status": "running",
+			"owner":  "ci",
+		}})
+	})
+
+	It("should merge changed fields", func() {
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "a", "fields": map[string]interface{}{
+			"status": "passed",
+		}})
+		Ω(collection.FindOne("a")).Should(Equal(map[string]interface{}{"name": "nightly", "status": "passed", "owner": "ci"}))
+	})
+
+	It("should delete cleared fields", func() {
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "a",
+			"fields":  map[string]interface{}{"status": "passed"},
+			"cleared": []interface{}{"owner"},
+		})
+		Ω(collection.FindOne("a")).Should(Equal(map[string]interface{}{"name": "nightly", "status": "passed"}))
+	})
+
+	It("should clear fields without setting any", func() {
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "a",
+			"cleared": []interface{}{"owner", "status", "missing"},
+		})
+		Ω(collection.FindOne("a")).Should(Equal(map[string]interface{}{"name": "nightly"}))
+		Ω(inconsistencies).Should(BeEmpty())
+	})
+
+	It("should keep documents added without fields", func() {
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "b"})
+		Ω(collection.FindOne("b")).Should(Equal(map[string]interface{}{}))
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "b", "fields": map[string]interface{}{"name": "b"}})
+		Ω(collection.FindOne("b")).Should(Equal(map[string]interface{}{"name": "b"}))
+	})
+
+	It("should report changes to unknown documents", func() {
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "z", "fields": map[string]interface{}{"name": "z"}})
+		Ω(collection.FindOne("z")).Should(BeNil())
+		Ω(inconsistencies).Should(Equal([]*ConsistencyError{{Collection: "builds", ID: "z", Type: "changed"}}))
+	})
+
+	It("should report removing unknown documents", func() {
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "a"})
+		Ω(collection.FindOne("a")).Should(BeNil())
+		Ω(inconsistencies).Should(BeEmpty())
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "a"})
+		Ω(inconsistencies).Should(HaveLen(1))
+		Ω(inconsistencies[0].Type).Should(Equal("removed"))
+		Ω(inconsistencies[0].Error()).Should(Equal(`removed message for unknown document "a" in collection "builds"`))
+	})
+})
+
+var _ = Describe("Consistency errors", func() {
+
+	It("should be reported by the client's collections", func() {
+		server := newTestServer(func(msg map[string]interface{}, send func(interface{})) {
+			send(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "ghost", "fields": map[string]interface{}{"name": "boo"}})
+			send(map[string]interface{}{"msg": "result", "id": msg["id"]})
+		})
+		defer server.Close()
+		client, err := Dial(server.URL())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		errs := make(chan *ConsistencyError, 1)
+		client.OnConsistencyError(func(err *ConsistencyError) { errs <- err })
+
+		_, err = client.Call("haunt", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(errs).Should(Receive(Equal(&ConsistencyError{Collection: "builds", ID: "ghost", Type: "changed"})))
+		Ω(client.CollectionByName("builds").FindAll()).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Change events", func() {
+
+	It("should describe every change", func() {
+		collection := NewCollection("builds").(*KeyCache)
+		events := make(chan ChangeEvent, 10)
+		collection.AddChangeListener(events)
+
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "a", "fields": map[string]interface{}{"name": "nightly", "owner": "ci"}})
+		var event ChangeEvent
+		Eventually(events).Should(Receive(&event))
+		Ω(event).Should(Equal(ChangeEvent{
+			Kind:       Added,
+			Collection: "builds",
+			ID:         "a",
+			Fields:     map[string]interface{}{"name": "nightly", "owner": "ci"},
+			After:      map[string]interface{}{"name": "nightly", "owner": "ci"},
+		}))
+
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "a",
+			"fields":  map[string]interface{}{"status": "passed"},
+			"cleared": []interface{}{"owner"},
+		})
+		Eventually(events).Should(Receive(&event))
+		Ω(event).Should(Equal(ChangeEvent{
+			Kind:       Changed,
+			Collection: "builds",
+			ID:         "a",
+			Fields:     map[string]interface{}{"status": "passed"},
+			Cleared:    []string{"owner"},
+			Before:     map[string]interface{}{"name": "nightly", "owner": "ci"},
+			After:      map[string]interface{}{"name": "nightly", "status": "passed"},
+		}))
+
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "a"})
+		Eventually(events).Should(Receive(&event))
+		Ω(event).Should(Equal(ChangeEvent{
+			Kind:       Removed,
+			Collection: "builds",
+			ID:         "a",
+			Before:     map[string]interface{}{"name": "nightly", "status": "passed"},
+		}))
+
+		collection.Reset()
+		Eventually(events).Should(Receive(&event))
+		Ω(event).Should(Equal(ChangeEvent{Kind: Reset, Collection: "builds"}))
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	It("should not block on update listeners", func() {
+		collection := NewCollection("builds")
+		updates := make(chan map[string]interface{})
+		collection.AddUpdateListener(updates)
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "a", "fields": map[string]interface{}{"name": "nightly"}})
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "a", "cleared": []interface{}{"name"}})
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "a"})
+
+		Eventually(updates).Should(Receive(Equal(map[string]interface{}{"msg": "added", "collection": "builds", "id": "a", "fields": map[string]interface{}{"name": "nightly"}})))
+		Eventually(updates).Should(Receive(Equal(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "a", "fields": map[string]interface{}(nil), "cleared": []interface{}{"name"}})))
+		Consistently(updates).ShouldNot(Receive())
+	})
+
+	It("should stop sending to removed listeners", func() {
+		collection := NewCollection("builds").(*KeyCache)
+		updates := make(chan map[string]interface{})
+		events := make(chan ChangeEvent)
+		collection.AddUpdateListener(updates)
+		collection.AddChangeListener(events)
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "a"})
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "b"})
+		Eventually(events).Should(Receive())
+		Eventually(updates).Should(Receive())
+
+		before := runtime.NumGoroutine()
+		collection.RemoveUpdateListener(updates)
+		collection.RemoveChangeListener(events)
+		// Both forwarders were blocked handing over "b"
+		Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", before-4))
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "c"})
+		Consistently(events).ShouldNot(Receive())
+		Consistently(updates).ShouldNot(Receive())
+	})
+
+	It("should not send events for unknown documents", func() {
+		collection := NewCollection("builds").(*KeyCache)
+		collection.OnConsistencyError(func(*ConsistencyError) {})
+		events := make(chan ChangeEvent, 10)
+		collection.AddChangeListener(events)
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "z"})
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "z"})
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	It("should not report unchanged documents on reconnect", func() {
+		server := newTestServer(func(msg map[string]interface{}, send func(interface{})) {
+			if msg["msg"] == "sub" {
+				send(map[string]interface{}{"msg": "added", "collection": "builds", "id": "a", "fields": map[string]interface{}{"name": "a"}})
+				send(map[string]interface{}{"msg": "ready", "subs": []string{msg["id"].(string)}})
+			}
+		})
+		defer server.Close()
+		client, err := Dial(server.URL(), WithReconnectPolicy(NewExponentialBackoff(10*time.Millisecond, 10*time.Millisecond)))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		events := make(chan ChangeEvent, 10)
+		client.CollectionByName("builds").(ChangeNotifier).AddChangeListener(events)
+		Ω(client.Sub("builds", nil)).Should(Succeed())
+
+		var event ChangeEvent
+		Eventually(events).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Added))
+
+		server.Drop()
+		Eventually(func() int { return len(server.Received("sub")) }, 2*time.Second).Should(Equal(2))
+		Consistently(events, 200*time.Millisecond).ShouldNot(Receive())
+		Ω(client.CollectionByName("builds").FindAll()).Should(HaveLen(1))
+	})
+})
+
+var _ = Describe("OrderedCache", func() {
+
+	var collection *OrderedCache
+	var inconsistencies []*ConsistencyError
+
+	addBefore := func(id, before string) {
+		msg := map[string]interface{}{"msg": "addedBefore", "collection": "steps", "id": id, "fields": map[string]interface{}{"name": id}, "before": nil}
+		if before != "" {
+			msg["before"] = before
+		}
+		collection.AddedBefore(msg)
+	}
+	moveBefore := func(id, before string) {
+		msg := map[string]interface{}{"msg": "movedBefore", "collection": "steps", "id": id, "before": nil}
+		if before != "" {
+			msg["before"] = before
+		}
+		collection.MovedBefore(msg)
+	}
+
+	BeforeEach(func() {
+		collection = NewOrderedCollection("steps").(*OrderedCache)
+		inconsistencies = nil
+		collection.OnConsistencyError(func(err *ConsistencyError) {
+			inconsistencies = append(inconsistencies, err)
+		})
+		addBefore("c", "")
+		addBefore("a", "c")
+		addBefore("b", "c")
+	})
+
+	It("should add documents in position", func() {
+		Ω(collection.IDs()).Should(Equal([]string{"a", "b", "c"}))
+		Ω(collection.Len()).Should(Equal(3))
+		Ω(collection.IndexOf("b")).Should(Equal(1))
+		Ω(collection.IndexOf("z")).Should(Equal(-1))
+		id, item := collection.At(2)
+		Ω(id).Should(Equal("c"))
+		Ω(item).Should(Equal(map[string]interface{}{"name": "c"}))
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "steps", "id": "d"})
+		Ω(collection.IDs()).Should(Equal([]string{"a", "b", "c", "d"}))
+	})
+
+	It("should move documents", func() {
+		moveBefore("c", "a")
+		Ω(collection.IDs()).Should(Equal([]string{"c", "a", "b"}))
+		moveBefore("c", "")
+		Ω(collection.IDs()).Should(Equal([]string{"a", "b", "c"}))
+		moveBefore("a", "c")
+		Ω(collection.IDs()).Should(Equal([]string{"b", "a", "c"}))
+		Ω(inconsistencies).Should(BeEmpty())
+	})
+
+	It("should keep the position of changed documents and drop removed ones", func() {
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "steps", "id": "b", "fields": map[string]interface{}{"ok": true}})
+		Ω(collection.IDs()).Should(Equal([]string{"a", "b", "c"}))
+		Ω(collection.FindOne("b")).Should(Equal(map[string]interface{}{"name": "b", "ok": true}))
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "steps", "id": "a"})
+		Ω(collection.IDs()).Should(Equal([]string{"b", "c"}))
+		collection.Reset()
+		Ω(collection.IDs()).Should(BeEmpty())
+		Ω(collection.FindAll()).Should(BeEmpty())
+	})
+
+	It("should report unknown documents", func() {
+		moveBefore("z", "a")
+		addBefore("d", "y")
+		moveBefore("a", "x")
+		Ω(collection.IDs()).Should(Equal([]string{"b", "c", "d", "a"}))
+		Ω(inconsistencies).Should(Equal([]*ConsistencyError{
+			{Collection: "steps", ID: "z", Type: "movedBefore"},
+			{Collection: "steps", ID: "y", Type: "addedBefore"},
+			{Collection: "steps", ID: "x", Type: "movedBefore"},
+		}))
+	})
+
+	It("should iterate in order", func() {
+		ids := []string{}
+		collection.ForEach(func(index int, id string, item interface{}) bool {
+			ids = append(ids, id)
+			return index < 1
+		})
+		Ω(ids).Should(Equal([]string{"a", "b"}))
+	})
+
+	It("should send positions with change events", func() {
+		watcher := collection.Watch(0, DropOldest)
+		defer watcher.Stop()
+		addBefore("d", "b")
+		moveBefore("a", "")
+		var event ChangeEvent
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Added))
+		Ω(event.BeforeID).Should(Equal("b"))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Moved))
+		Ω(event.ID).Should(Equal("a"))
+		Ω(event.BeforeID).Should(BeEmpty())
+		Ω(event.After).Should(Equal(map[string]interface{}{"name": "a"}))
+	})
+
+	It("should find documents in collection order", func() {
+		moveBefore("c", "a")
+		docs := collection.Find(Selector{"name": Selector{"$ne": "b"}}, nil).All()
+		Ω(docs).Should(HaveLen(2))
+		Ω(docs[0]["_id"]).Should(Equal("c"))
+		Ω(docs[1]["_id"]).Should(Equal("a"))
+	})
+
+	It("should follow the collection order in live queries", func() {
+		var lock sync.Mutex
+		calls := []string{}
+		live, err := collection.Find(nil, nil).ObserveChanges(ObserveChangesCallbacks{
+			AddedBefore: func(id string, fields map[string]interface{}, before string) {
+				lock.Lock()
+				defer lock.Unlock()
+				calls = append(calls, "added "+id+" before "+before)
+			},
+			MovedBefore: func(id, before string) {
+				lock.Lock()
+				defer lock.Unlock()
+				calls = append(calls, "moved "+id+" before "+before)
+			},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer live.Stop()
+		moveBefore("c", "a")
+		addBefore("d", "a")
+		Eventually(func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]string{}, calls...)
+		}).Should(Equal([]string{
+			"added a before ", "added b before ", "added c before ",
+			"moved c before a",
+			"added d before a",
+		}))
+	})
+
+	It("should be used by the client for ordered publications", func() {
+		server := newTestServer(func(msg map[string]interface{}, send func(interface{})) {
+			send(map[string]interface{}{"msg": "addedBefore", "collection": "steps", "id": "b", "before": nil})
+			send(map[string]interface{}{"msg": "addedBefore", "collection": "steps", "id": "a", "before": "b"})
+			send(map[string]interface{}{"msg": "addedBefore", "collection": "builds", "id": "x", "before": nil})
+			send(map[string]interface{}{"msg": "result", "id": msg["id"]})
+		})
+		defer server.Close()
+		client, err := Dial(server.URL())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		builds := client.CollectionByName("builds")
+
+		_, err = client.Call("publish", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		steps, ok := client.CollectionByName("steps").(*OrderedCache)
+		Ω(ok).Should(BeTrue())
+		Ω(steps.IDs()).Should(Equal([]string{"a", "b"}))
+		// Existing collections are kept, and still store the documents
+		Ω(client.CollectionByName("builds")).Should(BeIdenticalTo(builds))
+		Ω(builds.FindOne("x")).Should(Equal(map[string]interface{}{}))
+	})
+})
+
+// plainCollection has only the methods of the Collection interface, like a
+// collection written before the optional interfaces existed.
+type plainCollection struct {
+	Collection
+}
+
+var _ = Describe("Custom collections", func() {
+
+	It("should be queried but not watched", func() {
+		plain := plainCollection{NewCollection("builds")}
+		plain.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "a", "fields": map[string]interface{}{"duration": 10.0}})
+		plain.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "b", "fields": map[string]interface{}{"duration": 1.0}})
+		Ω(NewCursor(plain, Selector{"duration": Selector{"$gt": 5.0}}, nil).Count()).Should(Equal(1))
+
+		watcher := NewTypedCollection[map[string]interface{}](plain).Watch(0, DropOldest)
+		Eventually(watcher.Events()).Should(BeClosed())
+		Ω(watcher.Err()).Should(MatchError(ErrNotWatchable))
+		_, err := NewCursor(plain, nil, nil).ObserveChanges(ObserveChangesCallbacks{
+			Added: func(id string, fields map[string]interface{}) {},
+		})
+		Ω(err).Should(MatchError(ErrNotWatchable))
+	})
+})
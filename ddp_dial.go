@@ -0,0 +1,160 @@
+package ddp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// newConfig creates the websocket configuration used to dial the server.
+func (c *Client) newConfig(server string) (*websocket.Config, error) {
+	config, err := websocket.NewConfig(server, c.origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Header = c.dialOptions.header
+	config.TlsConfig = c.dialOptions.tlsConfig
+	config.Dialer = c.dialOptions.dialer
+	config.Protocol = c.dialOptions.protocols
+	return config, nil
+}
+
+// dial opens a transport to the server with the configured TransportDialer,
+// or a websocket by default. SockJS connections get a fresh session URL
+// every time.
+func (c *Client) dial(ctx context.Context) (Transport, error) {
+	config := c.config
+	if c.dialOptions.sockJS && isSockJSBase(c.config.Location) {
+		location := sockJSURL(c.config.Location)
+		copied := *c.config
+		copied.Location = location
+		config = &copied
+	}
+	var transport Transport
+	if c.dialOptions.transport != nil {
+		var err error
+		transport, err = c.dialOptions.transport(ctx, config.Location.String())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ws, err := dialWebsocket(ctx, config, c.dialOptions.proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport = NewWebsocketTransport(ws)
+	}
+	if c.dialOptions.sockJS {
+		transport = NewSockJSTransport(transport)
+	}
+	return transport, nil
+}
+
+// dialWebsocket opens a websocket to the server, through the proxy if one
+// is configured.
+func dialWebsocket(ctx context.Context, config *websocket.Config, proxy func(*http.Request) (*url.URL, error)) (*websocket.Conn, error) {
+	if proxy != nil {
+		target := *config.Location
+		if target.Scheme == "wss" {
+			target.Scheme = "https"
+		} else {
+			target.Scheme = "http"
+		}
+		proxyURL, err := proxy(&http.Request{Method: "GET", URL: &target, Header: http.Header{}})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			return dialProxy(ctx, config, proxyURL)
+		}
+	}
+	return config.DialContext(ctx)
+}
+
+// dialProxy opens a websocket to the server tunneled through an HTTP proxy.
+func dialProxy(ctx context.Context, config *websocket.Config, proxyURL *url.URL) (*websocket.Conn, error) {
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	ws, err := tunnel(ctx, config, conn, proxyURL)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// tunnel asks the proxy on conn to connect to the server, then performs the
+// TLS and websocket handshakes through the tunnel.
+func tunnel(ctx context.Context, config *websocket.Config, conn net.Conn, proxyURL *url.URL) (*websocket.Conn, error) {
+	target := hostPort(config.Location)
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyURL.Host, target, resp.Status)
+	}
+
+	if config.Location.Scheme == "wss" {
+		tlsConfig := &tls.Config{}
+		if config.TlsConfig != nil {
+			tlsConfig = config.TlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = config.Location.Hostname()
+		}
+		secure := tls.Client(conn, tlsConfig)
+		if err := secure.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = secure
+	}
+	return websocket.NewClient(config, conn)
+}
+
+// hostPort returns the host:port address for a URL, using the default port
+// for the scheme if none is given.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "wss", "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
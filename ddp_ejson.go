@@ -0,0 +1,69 @@
+package ddp
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+// EJSON
+//
+// Meteor extends JSON with a handful of special objects (EJSON) for
+// values JSON can't express. We convert them to the plain JSON forms
+// encoding/json expects so results can be decoded into Go types:
+//
+//   {"$date": ms}        - RFC 3339 string (decodes into time.Time)
+//   {"$binary": base64}  - base64 string (decodes into []byte)
+//   {"$escape": {...}}   - the escaped object with its keys taken literally
+//
+// Custom types ({"$type": ..., "$value": ...}) are passed through as objects.
+// ----------------------------------------------------------------------
+
+// decodeEJSON decodes a generic json decoded EJSON value into out, which
+// must be a pointer. A nil value leaves out untouched.
+func decodeEJSON(in interface{}, out interface{}) error {
+	if in == nil {
+		return nil
+	}
+	data, err := json.Marshal(fromEJSON(in))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// fromEJSON returns a copy of a generic json decoded value with all EJSON
+// special objects converted to plain JSON values.
+func fromEJSON(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[string]interface{}:
+		if len(v) == 1 {
+			if ms, ok := v["$date"].(float64); ok {
+				return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+			}
+			if b, ok := v["$binary"].(string); ok {
+				return b
+			}
+			if escaped, ok := v["$escape"].(map[string]interface{}); ok {
+				out := make(map[string]interface{}, len(escaped))
+				for key, value := range escaped {
+					out[key] = fromEJSON(value)
+				}
+				return out
+			}
+		}
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[key] = fromEJSON(value)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = fromEJSON(value)
+		}
+		return out
+	default:
+		return in
+	}
+}
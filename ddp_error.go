@@ -0,0 +1,106 @@
+package ddp
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error is an error reported by the server. It mirrors the fields of a
+// Meteor.Error sent in the `error` object of DDP messages.
+type Error struct {
+	// Code is the error code sent in the `error` field. Meteor sends either
+	// a number such as 403 or a string such as "too-many-requests". Numbers
+	// are formatted as decimal strings so codes can be compared directly.
+	Code string
+	// Reason is an optional human readable reason for the error.
+	Reason string
+	// Message is the formatted message, usually "reason [code]".
+	Message string
+	// ErrorType is the class of the error, usually "Meteor.Error".
+	ErrorType string
+	// Details holds any extra data the server attached to the error.
+	Details interface{}
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("%s [%s]", e.Reason, e.Code)
+	}
+	return fmt.Sprintf("[%s]", e.Code)
+}
+
+// UnmarshalJSON decodes the `error` field of a DDP message.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*e = *newError(raw)
+	return nil
+}
+
+// VersionError is returned when the client and server have no DDP protocol
+// version in common.
+type VersionError struct {
+	// Suggested is the version the server asked the client to use.
+	Suggested string
+	// Supported lists the versions the client supports.
+	Supported []string
+}
+
+// Error implements the error interface.
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("server requires DDP version %q, client supports %v", e.Suggested, e.Supported)
+}
+
+// ConsistencyError reports a live data message that doesn't match the
+// local cache, such as a change to a document the client doesn't have. It
+// usually means a server or client bug.
+type ConsistencyError struct {
+	// Collection is the name of the collection.
+	Collection string
+	// ID is the id of the document.
+	ID string
+	// Type is the type of the offending message, e.g. "changed".
+	Type string
+}
+
+// Error implements the error interface.
+func (e *ConsistencyError) Error() string {
+	return fmt.Sprintf("%s message for unknown document %q in collection %q", e.Type, e.ID, e.Collection)
+}
+
+// newError creates an Error from the generic json decoded `error` field of
+// a DDP message.
+func newError(raw interface{}) *Error {
+	e := &Error{}
+	switch fields := raw.(type) {
+	case map[string]interface{}:
+		e.Code = errorCode(fields["error"])
+		e.Reason, _ = fields["reason"].(string)
+		e.Message, _ = fields["message"].(string)
+		e.ErrorType, _ = fields["errorType"].(string)
+		e.Details = fields["details"]
+	case string:
+		e.Message = fields
+	default:
+		e.Message = fmt.Sprintf("%v", raw)
+	}
+	return e
+}
+
+// errorCode formats a Meteor error code as a string.
+func errorCode(code interface{}) string {
+	switch c := code.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	default:
+		return fmt.Sprintf("%v", c)
+	}
+}
@@ -0,0 +1,321 @@
+package ddp
+
+import (
+	"reflect"
+	"sort"
+)
+
+// ----------------------------------------------------------------------
+// Merging subscriptions
+//
+// A Meteor server merges the documents of all a client's subscriptions
+// before sending them (the merge box), so a document published twice is
+// added once and only removed when the last subscription drops it. Servers
+// without a merge box send every subscription's data as is. With
+// WithMergeBox the client does the merging itself: collections record the
+// subscriptions behind every document and the value each one published for
+// every field, rewrite the data messages to what a merging server would
+// have sent, and drop exactly a subscription's data when it stops.
+//
+// Data messages don't name their subscription, so the client credits them
+// to the earliest subscription still sending its initial data. Once every
+// subscription is ready there is no telling who sent a message: changes
+// go to the subscriptions already behind the document, and documents added
+// then are left unowned - Owners doesn't know them and no subscription
+// stopping removes them. Removals are credited to the subscriptions being
+// stopped, or remove the document outright.
+//
+// Against a server that merges subscriptions itself, as Meteor does, the
+// client can't tell which subscriptions publish a document: a second
+// subscription publishing it sends nothing at all. Ownership is only
+// tracked with WithMergeBox.
+// ----------------------------------------------------------------------
+
+// mergedDoc records the subscriptions behind a document and the values
+// they published for its fields, in the order they published them. The
+// first value of a field is the one the collection holds.
+type mergedDoc struct {
+	subs   map[string]bool
+	fields map[string][]publishedValue
+}
+
+// publishedValue is the value a subscription published for a field.
+type publishedValue struct {
+	sub   string
+	value interface{}
+}
+
+// merger is implemented by collections that merge the data of several
+// subscriptions.
+type merger interface {
+	trackOwners()
+	merge(msg map[string]interface{}, subs []string) map[string]interface{}
+	release(sub string) []map[string]interface{}
+	mergedDocs() map[string]*mergedDoc
+	adoptMerged(docs map[string]*mergedDoc)
+}
+
+// Owners returns the sorted ids of the subscriptions that published the
+// document. ok is false if the collection doesn't track them, which it only
+// does for clients created with WithMergeBox, or if the document arrived
+// when no subscription could be credited with it.
+func (c *KeyCache) Owners(id string) (subs []string, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.merged == nil {
+		return nil, false
+	}
+	doc, found := c.merged[id]
+	if !found {
+		_, unowned := c.items[id]
+		return nil, !unowned
+	}
+	return doc.owners(), true
+}
+
+// trackOwners starts tracking the subscriptions behind the documents.
+func (c *KeyCache) trackOwners() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.merged == nil {
+		c.merged = map[string]*mergedDoc{}
+	}
+}
+
+// resetMerged forgets the subscriptions behind the documents, if they are
+// tracked. The caller must hold the lock.
+func (c *KeyCache) resetMerged() {
+	if c.merged != nil {
+		c.merged = map[string]*mergedDoc{}
+	}
+}
+
+// merge credits a data message to subs and returns the message to apply to
+// the collection, or nil if the merged document doesn't change. Other
+// messages credited to no subscription go to the document's owners, and
+// removals remove the document.
+func (c *KeyCache) merge(msg map[string]interface{}, subs []string) map[string]interface{} {
+	id := idForMessage(msg)
+	msgType, _ := msg["msg"].(string)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.merged == nil {
+		c.merged = map[string]*mergedDoc{}
+	}
+	doc, ok := c.merged[id]
+	if ok && len(subs) == 0 {
+		subs = doc.owners()
+	}
+	switch msgType {
+	case "added", "addedBefore":
+		fields, _ := msg["fields"].(map[string]interface{})
+		if !ok {
+			if len(subs) == 0 {
+				return msg
+			}
+			doc = &mergedDoc{subs: map[string]bool{}, fields: map[string][]publishedValue{}}
+			c.merged[id] = doc
+			doc.publish(subs, fields, nil)
+			return msg
+		}
+		// Already published by another subscription
+		set, cleared := doc.publish(subs, fields, nil)
+		return c.changedMessage(id, set, cleared)
+	case "changed":
+		if !ok {
+			return msg
+		}
+		fields, _ := msg["fields"].(map[string]interface{})
+		raw, _ := msg["cleared"].([]interface{})
+		var cleared []string
+		for _, key := range raw {
+			if key, ok := key.(string); ok {
+				cleared = append(cleared, key)
+			}
+		}
+		set, cleared := doc.publish(subs, fields, cleared)
+		return c.changedMessage(id, set, cleared)
+	case "removed":
+		if !ok || len(subs) == 0 {
+			delete(c.merged, id)
+			return msg
+		}
+		return c.drop(id, doc, subs)
+	}
+	return msg
+}
+
+// release drops everything sub published and returns the messages that
+// bring the collection up to date.
+func (c *KeyCache) release(sub string) []map[string]interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ids := make([]string, 0, len(c.merged))
+	for id, doc := range c.merged {
+		if doc.subs[sub] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	msgs := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if msg := c.drop(id, c.merged[id], []string{sub}); msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// mergedDocs returns the merged documents.
+func (c *KeyCache) mergedDocs() map[string]*mergedDoc {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merged
+}
+
+// adoptMerged replaces the merged documents, after the collection has been
+// patched to match them.
+func (c *KeyCache) adoptMerged(docs map[string]*mergedDoc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if docs == nil {
+		docs = map[string]*mergedDoc{}
+	}
+	c.merged = docs
+}
+
+// drop removes subs from a merged document, returning a removed message if
+// nothing is left of it. The caller must hold the lock.
+func (c *KeyCache) drop(id string, doc *mergedDoc, subs []string) map[string]interface{} {
+	for _, sub := range subs {
+		delete(doc.subs, sub)
+	}
+	if len(doc.subs) == 0 {
+		delete(c.merged, id)
+		return map[string]interface{}{"msg": "removed", "collection": c.Name, "id": id}
+	}
+	set, cleared := doc.unpublish(subs)
+	return c.changedMessage(id, set, cleared)
+}
+
+// changedMessage builds a changed message for a document, or returns nil
+// if nothing changed.
+func (c *KeyCache) changedMessage(id string, fields map[string]interface{}, cleared []string) map[string]interface{} {
+	if len(fields) == 0 && len(cleared) == 0 {
+		return nil
+	}
+	return changedMessage(c.Name, id, fields, cleared)
+}
+
+// owners returns the sorted ids of the subscriptions behind the document.
+func (d *mergedDoc) owners() []string {
+	subs := make([]string, 0, len(d.subs))
+	for sub := range d.subs {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+	return subs
+}
+
+// publish records the fields subs set and cleared, returning the changes to
+// the visible fields.
+func (d *mergedDoc) publish(subs []string, fields map[string]interface{}, cleared []string) (map[string]interface{}, []string) {
+	touched := map[string]bool{}
+	before := d.visible()
+	for _, sub := range subs {
+		d.subs[sub] = true
+		for key, value := range fields {
+			d.set(sub, key, value)
+			touched[key] = true
+		}
+		for _, key := range cleared {
+			d.clear(sub, key)
+			touched[key] = true
+		}
+	}
+	return d.changes(before, touched)
+}
+
+// unpublish removes every value subs published, returning the changes to
+// the visible fields.
+func (d *mergedDoc) unpublish(subs []string) (map[string]interface{}, []string) {
+	touched := map[string]bool{}
+	before := d.visible()
+	for key := range d.fields {
+		for _, sub := range subs {
+			d.clear(sub, key)
+		}
+		touched[key] = true
+	}
+	return d.changes(before, touched)
+}
+
+// set records the value sub published for a field.
+func (d *mergedDoc) set(sub, key string, value interface{}) {
+	values := d.fields[key]
+	for i := range values {
+		if values[i].sub == sub {
+			values[i].value = value
+			return
+		}
+	}
+	d.fields[key] = append(values, publishedValue{sub: sub, value: value})
+}
+
+// clear forgets the value sub published for a field.
+func (d *mergedDoc) clear(sub, key string) {
+	values := d.fields[key]
+	for i := range values {
+		if values[i].sub == sub {
+			values = append(values[:i:i], values[i+1:]...)
+			break
+		}
+	}
+	if len(values) == 0 {
+		delete(d.fields, key)
+		return
+	}
+	d.fields[key] = values
+}
+
+// visible returns the values the collection holds for the fields.
+func (d *mergedDoc) visible() map[string]interface{} {
+	fields := make(map[string]interface{}, len(d.fields))
+	for key, values := range d.fields {
+		fields[key] = values[0].value
+	}
+	return fields
+}
+
+// changes compares the touched fields with their visible values before,
+// returning the fields that were set and those no longer published.
+func (d *mergedDoc) changes(before map[string]interface{}, touched map[string]bool) (map[string]interface{}, []string) {
+	fields := map[string]interface{}{}
+	var cleared []string
+	for key := range touched {
+		old, had := before[key]
+		values, has := d.fields[key]
+		switch {
+		case has && (!had || !reflect.DeepEqual(old, values[0].value)):
+			fields[key] = values[0].value
+		case had && !has:
+			cleared = append(cleared, key)
+		}
+	}
+	sort.Strings(cleared)
+	return fields, cleared
+}
+
+// changedMessage builds a changed message setting fields and clearing the
+// fields listed in cleared.
+func changedMessage(collection, id string, fields map[string]interface{}, cleared []string) map[string]interface{} {
+	msg := map[string]interface{}{"msg": "changed", "collection": collection, "id": id, "fields": fields}
+	if len(cleared) > 0 {
+		keys := make([]interface{}, len(cleared))
+		for i, key := range cleared {
+			keys[i] = key
+		}
+		msg["cleared"] = keys
+	}
+	return msg
+}
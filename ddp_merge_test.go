@@ -0,0 +1,169 @@
+package ddp_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Merge box", func() {
+
+	// The server publishes every subscription's documents without merging
+	// them and removes them again on unsub.
+	publications := map[string][]map[string]interface{}{
+		"left":  {{"name": "x", "left": 1.0}, {"name": "only-left"}},
+		"right": {{"name": "x", "right": 2.0}},
+	}
+	var lock sync.Mutex
+	var push func(interface{})
+	var server *testServer
+	var client *Client
+
+	dial := func(opts ...Option) {
+		var err error
+		client, err = Dial(server.URL(), append(opts, WithReconnectPolicy(NewExponentialBackoff(10*time.Millisecond, 10*time.Millisecond)))...)
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+	subscribe := func(name string) *Subscription {
+		sub, err := client.SubContext(context.Background(), name)
+		Ω(err).ShouldNot(HaveOccurred())
+		return sub
+	}
+	builds := func() Collection {
+		return client.CollectionByName("builds")
+	}
+	owners := func(id string) []string {
+		subs, ok := builds().(*KeyCache).Owners(id)
+		Ω(ok).Should(BeTrue())
+		return subs
+	}
+
+	BeforeEach(func() {
+		names := map[string]string{}
+		server = newTestServer(func(msg map[string]interface{}, send func(interface{})) {
+			lock.Lock()
+			push = send
+			lock.Unlock()
+			id, _ := msg["id"].(string)
+			switch msg["msg"] {
+			case "sub":
+				name := msg["name"].(string)
+				names[id] = name
+				for _, doc := range publications[name] {
+					fields := map[string]interface{}{}
+					for key, value := range doc {
+						if key != "name" {
+							fields[key] = value
+						}
+					}
+					send(map[string]interface{}{"msg": "added", "collection": "builds", "id": doc["name"], "fields": fields})
+				}
+				if name == "broken" {
+					send(map[string]interface{}{"msg": "added", "collection": "builds", "id": "partial"})
+					send(map[string]interface{}{"msg": "nosub", "id": id, "error": map[string]interface{}{"error": 500, "reason": "failed"}})
+					return
+				}
+				send(map[string]interface{}{"msg": "ready", "subs": []string{id}})
+			case "unsub":
+				for _, doc := range publications[names[id]] {
+					send(map[string]interface{}{"msg": "removed", "collection": "builds", "id": doc["name"]})
+				}
+				send(map[string]interface{}{"msg": "nosub", "id": id})
+			}
+		})
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should keep a document until every subscription publishing it stops", func() {
+		dial(WithMergeBox())
+		left, right := subscribe("left"), subscribe("right")
+		Ω(builds().FindOne("x")).Should(Equal(map[string]interface{}{"left": 1.0, "right": 2.0}))
+		Ω(owners("x")).Should(ConsistOf(left.ID, right.ID))
+		Ω(owners("only-left")).Should(Equal([]string{left.ID}))
+
+		Ω(left.Stop()).Should(Succeed())
+		Ω(builds().FindOne("x")).Should(Equal(map[string]interface{}{"right": 2.0}))
+		Ω(builds().FindOne("only-left")).Should(BeNil())
+		Ω(owners("x")).Should(Equal([]string{right.ID}))
+
+		Ω(right.Stop()).Should(Succeed())
+		Ω(builds().FindAll()).Should(BeEmpty())
+		Ω(owners("x")).Should(BeNil())
+	})
+
+	It("should credit the data of concurrent subscriptions to each of them", func() {
+		dial(WithMergeBox())
+		left := client.Subscribe("left", []interface{}{}, nil)
+		right := client.Subscribe("right", []interface{}{}, nil)
+		Eventually(left.Ready()).Should(BeClosed())
+		Eventually(right.Ready()).Should(BeClosed())
+		Ω(owners("x")).Should(ConsistOf(left.ID, right.ID))
+		Ω(owners("only-left")).Should(Equal([]string{left.ID}))
+
+		Ω(right.Stop()).Should(Succeed())
+		Ω(builds().FindOne("x")).Should(Equal(map[string]interface{}{"left": 1.0}))
+		Ω(owners("x")).Should(Equal([]string{left.ID}))
+	})
+
+	It("should remove the data of a failed subscription", func() {
+		dial(WithMergeBox())
+		right := subscribe("right")
+		_, err := client.SubContext(context.Background(), "broken")
+		Ω(err).Should(HaveOccurred())
+		Ω(builds().FindOne("partial")).Should(BeNil())
+		Ω(builds().FindOne("x")).Should(Equal(map[string]interface{}{"right": 2.0}))
+		Ω(owners("x")).Should(Equal([]string{right.ID}))
+	})
+
+	It("should leave live data it can't attribute unowned", func() {
+		dial(WithMergeBox())
+		left, right := subscribe("left"), subscribe("right")
+		lock.Lock()
+		push(map[string]interface{}{"msg": "added", "collection": "builds", "id": "live"})
+		push(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "x", "fields": map[string]interface{}{"live": true}})
+		lock.Unlock()
+		Eventually(func() interface{} { return builds().FindOne("live") }).ShouldNot(BeNil())
+		Eventually(func() interface{} { return builds().FindOne("x") }).Should(HaveKeyWithValue("live", true))
+		_, ok := builds().(*KeyCache).Owners("live")
+		Ω(ok).Should(BeFalse())
+		// Changes go to the subscriptions already behind the document
+		Ω(owners("x")).Should(ConsistOf(left.ID, right.ID))
+
+		Ω(left.Stop()).Should(Succeed())
+		Ω(right.Stop()).Should(Succeed())
+		Ω(builds().FindOne("x")).Should(BeNil())
+		Ω(builds().FindOne("live")).ShouldNot(BeNil())
+		_, ok = builds().(*KeyCache).Owners("live")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("should know the owners after a reconnect", func() {
+		dial(WithMergeBox())
+		left, right := subscribe("left"), subscribe("right")
+		events := builds().(Watchable).Watch(0, DropOldest)
+		defer events.Stop()
+		server.Drop()
+		Eventually(func() int { return len(server.Received("sub")) }, 2*time.Second).Should(Equal(4))
+		Consistently(events.Events(), 200*time.Millisecond).ShouldNot(Receive())
+		Ω(owners("x")).Should(ConsistOf(left.ID, right.ID))
+		Ω(right.Stop()).Should(Succeed())
+		Ω(builds().FindOne("x")).Should(Equal(map[string]interface{}{"left": 1.0}))
+	})
+
+	It("should not track owners without a merge box", func() {
+		dial()
+		subscribe("left")
+		Ω(builds().FindOne("x")).Should(Equal(map[string]interface{}{"left": 1.0}))
+		_, ok := builds().(*KeyCache).Owners("x")
+		Ω(ok).Should(BeFalse())
+	})
+})
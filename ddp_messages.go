@@ -1,5 +1,10 @@
 package ddp
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // ------------------------------------------------------------
 // DDP Messages
 //
@@ -21,9 +26,20 @@ type Connect struct {
 	Session string   `json:"session,omitempty"`
 }
 
-// NewConnect creates a new connect message
+// supportedVersions lists the DDP protocol versions the client speaks in
+// order of preference.
+var supportedVersions = []string{"1", "pre2", "pre1"}
+
+// NewConnect creates a new connect message proposing the preferred version
 func NewConnect() *Connect {
-	return &Connect{Message: Message{Type: "connect"}, Version: "1", Support: []string{"1"}}
+	return NewConnectVersion(supportedVersions[0])
+}
+
+// NewConnectVersion creates a new connect message proposing the version.
+func NewConnectVersion(version string) *Connect {
+	support := make([]string, len(supportedVersions))
+	copy(support, supportedVersions)
+	return &Connect{Message: Message{Type: "connect"}, Version: version, Support: support}
 }
 
 // NewReconnect creates a new connect message with a session ID to resume.
@@ -80,3 +96,247 @@ func NewSub(id, subName string, args []interface{}) *Sub {
 		Args:    args,
 	}
 }
+
+// Unsub is used to send an unsubscribe request to the server.
+type Unsub Message
+
+// NewUnsub creates a new unsub object.
+func NewUnsub(id string) *Unsub {
+	return &Unsub{Type: "unsub", ID: id}
+}
+
+// ------------------------------------------------------------
+// Inbound DDP Messages
+//
+// Go structs for the messages the server sends. decodeMessage
+// validates each frame and returns one of these types.
+// ------------------------------------------------------------
+
+// ConnectedMessage is sent by the server when the DDP session is
+// established.
+type ConnectedMessage struct {
+	Message
+	Session string `json:"session"`
+}
+
+// FailedMessage is sent by the server when it doesn't speak the proposed
+// version.
+type FailedMessage struct {
+	Message
+	Version string `json:"version"`
+}
+
+// ResultMessage carries the outcome of a method call.
+type ResultMessage struct {
+	Message
+	Error  *Error      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// UpdatedMessage reports methods whose writes are all visible to the
+// client.
+type UpdatedMessage struct {
+	Message
+	Methods []string `json:"methods"`
+}
+
+// AddedMessage reports a document added to a collection.
+type AddedMessage struct {
+	Message
+	Collection string                 `json:"collection"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+}
+
+// ChangedMessage reports fields of a document that were set or cleared.
+type ChangedMessage struct {
+	Message
+	Collection string                 `json:"collection"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	Cleared    []string               `json:"cleared,omitempty"`
+}
+
+// RemovedMessage reports a document removed from a collection.
+type RemovedMessage struct {
+	Message
+	Collection string `json:"collection"`
+}
+
+// AddedBeforeMessage reports a document added to an ordered collection
+// before another document, or at the end if Before is empty.
+type AddedBeforeMessage struct {
+	Message
+	Collection string                 `json:"collection"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	Before     string                 `json:"before"`
+}
+
+// MovedBeforeMessage reports a document moved within an ordered collection
+// before another document, or to the end if Before is empty.
+type MovedBeforeMessage struct {
+	Message
+	Collection string `json:"collection"`
+	Before     string `json:"before"`
+}
+
+// ReadyMessage reports subscriptions whose initial data has been sent.
+type ReadyMessage struct {
+	Message
+	Subs []string `json:"subs"`
+}
+
+// NoSubMessage reports a subscription that stopped or failed to start.
+type NoSubMessage struct {
+	Message
+	Error *Error `json:"error,omitempty"`
+}
+
+// ErrorMessage reports a message the receiver could not handle.
+type ErrorMessage struct {
+	Message
+	Reason           string      `json:"reason"`
+	OffendingMessage interface{} `json:"offendingMessage,omitempty"`
+}
+
+// NewErrorMessage creates a new error message about the offending message,
+// which may be nil.
+func NewErrorMessage(reason string, offending interface{}) *ErrorMessage {
+	return &ErrorMessage{
+		Message:          Message{Type: "error"},
+		Reason:           reason,
+		OffendingMessage: offending,
+	}
+}
+
+// serverID is the undocumented cluster hint Meteor sends with no `msg`.
+type serverID struct {
+	ServerID string `json:"server_id"`
+}
+
+// decodeMessage decodes and validates a frame from the server. It returns
+// the typed message along with the generic decoded object, which is
+// returned even when validation fails so it can be reported.
+func decodeMessage(data []byte) (interface{}, map[string]interface{}, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("malformed message: %v", err)
+	}
+	if raw == nil {
+		return nil, nil, fmt.Errorf("message is not an object")
+	}
+	mtype, ok := raw["msg"]
+	if !ok {
+		if _, ok := raw["server_id"]; ok {
+			msg := &serverID{}
+			return msg, raw, unmarshalMessage(data, msg)
+		}
+		return nil, raw, fmt.Errorf("message has no msg field")
+	}
+	var msg interface{}
+	switch mtype {
+	case "connected":
+		msg = &ConnectedMessage{}
+	case "failed":
+		msg = &FailedMessage{}
+	case "ping":
+		msg = &Ping{}
+	case "pong":
+		msg = &Pong{}
+	case "result":
+		msg = &ResultMessage{}
+	case "updated":
+		msg = &UpdatedMessage{}
+	case "added":
+		msg = &AddedMessage{}
+	case "changed":
+		msg = &ChangedMessage{}
+	case "removed":
+		msg = &RemovedMessage{}
+	case "addedBefore":
+		msg = &AddedBeforeMessage{}
+	case "movedBefore":
+		msg = &MovedBeforeMessage{}
+	case "ready":
+		msg = &ReadyMessage{}
+	case "nosub":
+		msg = &NoSubMessage{}
+	case "error":
+		msg = &ErrorMessage{}
+	case "unsub":
+		msg = &Unsub{}
+	default:
+		return nil, raw, fmt.Errorf("unknown message type %v", mtype)
+	}
+	if err := unmarshalMessage(data, msg); err != nil {
+		return nil, raw, err
+	}
+	if err := validateMessage(msg, raw); err != nil {
+		return nil, raw, err
+	}
+	return msg, raw, nil
+}
+
+// unmarshalMessage decodes a frame into a typed message.
+func unmarshalMessage(data []byte, msg interface{}) error {
+	if err := json.Unmarshal(data, msg); err != nil {
+		return fmt.Errorf("malformed message: %v", err)
+	}
+	return nil
+}
+
+// validateMessage checks a typed message has the fields the protocol
+// requires.
+func validateMessage(msg interface{}, raw map[string]interface{}) error {
+	var missing string
+	switch m := msg.(type) {
+	case *ConnectedMessage:
+		if m.Session == "" {
+			missing = "session"
+		}
+	case *FailedMessage:
+		if m.Version == "" {
+			missing = "version"
+		}
+	case *ResultMessage:
+		if m.ID == "" {
+			missing = "id"
+		}
+	case *UpdatedMessage:
+		if m.Methods == nil {
+			missing = "methods"
+		}
+	case *AddedMessage:
+		missing = requireDocument(m.Collection, m.ID)
+	case *ChangedMessage:
+		missing = requireDocument(m.Collection, m.ID)
+	case *RemovedMessage:
+		missing = requireDocument(m.Collection, m.ID)
+	case *AddedBeforeMessage:
+		missing = requireDocument(m.Collection, m.ID)
+	case *MovedBeforeMessage:
+		missing = requireDocument(m.Collection, m.ID)
+	case *ReadyMessage:
+		if m.Subs == nil {
+			missing = "subs"
+		}
+	case *NoSubMessage, *Unsub:
+		if raw["id"] == nil {
+			missing = "id"
+		}
+	}
+	if missing != "" {
+		return fmt.Errorf("%v message is missing %s", raw["msg"], missing)
+	}
+	return nil
+}
+
+// requireDocument returns the name of the missing field of a document
+// message, or "" if none are missing.
+func requireDocument(collection, id string) string {
+	if collection == "" {
+		return "collection"
+	}
+	if id == "" {
+		return "id"
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package ddp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Version negotiation", func() {
+
+	It("should offer all supported versions", func() {
+		connect := NewConnect()
+		Ω(connect.Version).Should(Equal("1"))
+		Ω(connect.Support).Should(Equal([]string{"1", "pre2", "pre1"}))
+	})
+
+	It("should connect with the preferred version", func() {
+		server := newTestServer(nil)
+		defer server.Close()
+		client, err := NewClient(server.URL(), "http://localhost/")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(client.Version()).Should(Equal("1"))
+		Ω(server.Received("connect")).Should(HaveLen(1))
+	})
+
+	It("should retry with the server's suggested version", func() {
+		server := newTestServerVersion("pre2", nil)
+		defer server.Close()
+		client, err := NewClient(server.URL(), "http://localhost/")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(client.Version()).Should(Equal("pre2"))
+		Ω(client.Session()).Should(Equal("test-session"))
+		connects := server.Received("connect")
+		Ω(connects).Should(HaveLen(2))
+		Ω(connects[1]["version"]).Should(Equal("pre2"))
+	})
+
+	It("should fail when no version matches", func() {
+		server := newTestServerVersion("2", nil)
+		defer server.Close()
+		_, err := NewClient(server.URL(), "http://localhost/")
+		Ω(err).Should(HaveOccurred())
+		var versionErr *VersionError
+		Ω(errors.As(err, &versionErr)).Should(BeTrue())
+		Ω(versionErr.Suggested).Should(Equal("2"))
+		Ω(versionErr.Supported).Should(Equal([]string{"1", "pre2", "pre1"}))
+		Ω(server.Received("connect")).Should(HaveLen(1))
+
+		// The list is a copy
+		versionErr.Supported[0] = "changed"
+		Ω(NewConnect().Support).Should(Equal([]string{"1", "pre2", "pre1"}))
+	})
+})
+
+var _ = Describe("Inbound messages", func() {
+
+	It("should answer bad frames with an error and stay connected", func() {
+		clientEnd, serverEnd := NewPipe()
+		defer serverEnd.Close()
+		errs := make(chan map[string]interface{}, 10)
+		go func() {
+			for {
+				data, err := serverEnd.ReadMessage()
+				if err != nil {
+					return
+				}
+				var msg map[string]interface{}
+				json.Unmarshal(data, &msg)
+				switch msg["msg"] {
+				case "connect":
+					serverEnd.WriteMessage([]byte(`{"msg":"connected","session":"pipe-session"}`))
+				case "method":
+					// Write while still reading the client's replies
+					go func(id string) {
+						for _, frame := range []string{
+							`not json`,
+							`null`,
+							`{"msg":"result"}`,
+							`{"msg":"connected","session":5}`,
+							`{"msg":"bogus"}`,
+							`{"server_id":"0"}`,
+						} {
+							serverEnd.WriteMessage([]byte(frame))
+						}
+						serverEnd.WriteMessage([]byte(`{"msg":"result","id":"` + id + `","result":"ok"}`))
+					}(msg["id"].(string))
+				case "error":
+					errs <- msg
+				}
+			}
+		}()
+		client, err := Dial("pipe://test", WithTransport(func(ctx context.Context, url string) (Transport, error) {
+			return clientEnd, nil
+		}))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+
+		Ω(client.Call("garbage", nil)).Should(Equal("ok"))
+		reasons := []string{}
+		for i := 0; i < 5; i++ {
+			var msg map[string]interface{}
+			Eventually(errs).Should(Receive(&msg))
+			reasons = append(reasons, msg["reason"].(string))
+		}
+		Ω(reasons[0]).Should(ContainSubstring("malformed"))
+		Ω(reasons[1]).Should(ContainSubstring("not an object"))
+		Ω(reasons[2]).Should(Equal("result message is missing id"))
+		Ω(reasons[3]).Should(ContainSubstring("malformed"))
+		Ω(reasons[4]).Should(Equal("unknown message type bogus"))
+		Consistently(errs).ShouldNot(Receive())
+		Ω(client.Status().State).Should(Equal(Connected))
+		Ω(client.Session()).Should(Equal("pipe-session"))
+	})
+})
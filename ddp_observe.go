@@ -0,0 +1,436 @@
+package ddp
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ----------------------------------------------------------------------
+// Live queries
+//
+// Observing a cursor reports the documents matching its query and then
+// keeps reporting how the results change, like Meteor's observeChanges
+// and observe. The query is rerun against the changed document only,
+// unless it has skip, limit or ordered callbacks - then the result window
+// is recomputed and diffed on every change. Unsorted results follow the
+// order of an OrderedCache.
+// ----------------------------------------------------------------------
+
+// ObserveChangesCallbacks are called as the results of a query change.
+// Any of them may be nil. Setting AddedBefore or MovedBefore observes the
+// results in order, and then Added must be nil.
+//
+// Fields never include "_id". An empty before id means the end of the
+// results.
+type ObserveChangesCallbacks struct {
+	Added       func(id string, fields map[string]interface{})
+	AddedBefore func(id string, fields map[string]interface{}, before string)
+	Changed     func(id string, fields map[string]interface{}, cleared []string)
+	Removed     func(id string)
+	MovedBefore func(id string, before string)
+}
+
+// ObserveCallbacks are called with whole documents as the results of a
+// query change. Any of them may be nil. Setting AddedBefore or MovedBefore
+// observes the results in order, and then Added must be nil.
+type ObserveCallbacks struct {
+	Added       func(doc map[string]interface{})
+	AddedBefore func(doc map[string]interface{}, before string)
+	Changed     func(newDoc, oldDoc map[string]interface{})
+	Removed     func(oldDoc map[string]interface{})
+	MovedBefore func(doc map[string]interface{}, before string)
+}
+
+// LiveQuery is a running observation of a query.
+type LiveQuery struct {
+	watcher *Watcher
+	lock    sync.Mutex
+	stopped bool
+}
+
+// Stop ends the live query. A callback already under way may finish but no
+// more are made. Stop may be called from a callback.
+func (q *LiveQuery) Stop() {
+	q.lock.Lock()
+	q.stopped = true
+	q.lock.Unlock()
+	q.watcher.Stop()
+}
+
+// running reports whether the live query hasn't been stopped.
+func (q *LiveQuery) running() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return !q.stopped
+}
+
+// ObserveChanges calls the callbacks for every document in the results,
+// before it returns, and then as the results change until the live query
+// is stopped. Callbacks are called from one goroutine at a time. The
+// collection must be Watchable.
+func (c *Cursor) ObserveChanges(callbacks ObserveChangesCallbacks) (*LiveQuery, error) {
+	ordered := callbacks.AddedBefore != nil || callbacks.MovedBefore != nil
+	if ordered && callbacks.Added != nil {
+		return nil, fmt.Errorf("ddp: set only one of Added and AddedBefore")
+	}
+	return c.observe(ordered, func(event ChangeEvent) {
+		switch event.Kind {
+		case Added:
+			fields := withoutID(event.After)
+			if callbacks.AddedBefore != nil {
+				callbacks.AddedBefore(event.ID, fields, event.BeforeID)
+			} else if callbacks.Added != nil {
+				callbacks.Added(event.ID, fields)
+			}
+		case Changed:
+			if callbacks.Changed != nil {
+				callbacks.Changed(event.ID, event.Fields, event.Cleared)
+			}
+		case Removed:
+			if callbacks.Removed != nil {
+				callbacks.Removed(event.ID)
+			}
+		case Moved:
+			if callbacks.MovedBefore != nil {
+				callbacks.MovedBefore(event.ID, event.BeforeID)
+			}
+		}
+	})
+}
+
+// Observe is like ObserveChanges but passes whole projected documents to
+// the callbacks.
+func (c *Cursor) Observe(callbacks ObserveCallbacks) (*LiveQuery, error) {
+	ordered := callbacks.AddedBefore != nil || callbacks.MovedBefore != nil
+	if ordered && callbacks.Added != nil {
+		return nil, fmt.Errorf("ddp: set only one of Added and AddedBefore")
+	}
+	return c.observe(ordered, func(event ChangeEvent) {
+		switch event.Kind {
+		case Added:
+			if callbacks.AddedBefore != nil {
+				callbacks.AddedBefore(event.After, event.BeforeID)
+			} else if callbacks.Added != nil {
+				callbacks.Added(event.After)
+			}
+		case Changed:
+			if callbacks.Changed != nil {
+				callbacks.Changed(event.After, event.Before)
+			}
+		case Removed:
+			if callbacks.Removed != nil {
+				callbacks.Removed(event.Before)
+			}
+		case Moved:
+			if callbacks.MovedBefore != nil {
+				callbacks.MovedBefore(event.After, event.BeforeID)
+			}
+		}
+	})
+}
+
+// snapshotWatcher is implemented by collections that can start a watcher
+// in step with a snapshot of their items and, if ordered, their order.
+type snapshotWatcher interface {
+	watchSnapshot() (*Watcher, []string, map[string]interface{})
+}
+
+// observe starts a live query that sends changes to the results to emit.
+func (c *Cursor) observe(ordered bool, emit func(ChangeEvent)) (*LiveQuery, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var watcher *Watcher
+	var order []string
+	var items map[string]interface{}
+	if source, ok := c.collection.(snapshotWatcher); ok {
+		watcher, order, items = source.watchSnapshot()
+	} else {
+		source, ok := c.collection.(Watchable)
+		if !ok {
+			return nil, ErrNotWatchable
+		}
+		// Changes between the two calls may be seen twice - harmless, as
+		// each change is diffed against the results
+		watcher = source.Watch(0, DropOldest)
+		items = c.collection.FindAll()
+	}
+	live := &LiveQuery{watcher: watcher}
+	o := &observer{
+		query:    c.query,
+		ordered:  ordered,
+		windowed: ordered || c.query.skip > 0 || c.query.limit > 0,
+		order:    order,
+		matched:  map[string]map[string]interface{}{},
+		visible:  map[string]map[string]interface{}{},
+		emit: func(event ChangeEvent) {
+			if live.running() {
+				emit(event)
+			}
+		},
+	}
+	o.start(items)
+	go func() {
+		for event := range watcher.Events() {
+			o.apply(event)
+		}
+	}()
+	return live, nil
+}
+
+// observer tracks the results of a live query.
+type observer struct {
+	query *query
+	// ordered observers report positions.
+	ordered bool
+	// windowed observers recompute all the results on every change.
+	windowed bool
+	// order holds the ids in collection order, nil if unordered.
+	order []string
+	// matched holds every matching document, with its "_id", by id.
+	matched map[string]map[string]interface{}
+	// ids are the ids in the results, in order, for windowed observers.
+	ids []string
+	// visible holds the projected documents in the results by id.
+	visible map[string]map[string]interface{}
+	emit    func(ChangeEvent)
+}
+
+// start reports the initial results from a snapshot of the collection.
+func (o *observer) start(items map[string]interface{}) {
+	for id, item := range items {
+		o.match(id, item)
+	}
+	o.ids = o.query.window(o.order, o.matched)
+	for _, id := range o.ids {
+		doc := o.view(id)
+		o.visible[id] = doc
+		o.emit(ChangeEvent{Kind: Added, ID: id, Fields: withoutID(doc), After: doc})
+	}
+	if !o.windowed {
+		o.ids = nil
+	}
+}
+
+// apply updates the results for a change to the collection.
+func (o *observer) apply(event ChangeEvent) {
+	if o.order != nil {
+		o.reorder(event)
+	}
+	switch event.Kind {
+	case Moved:
+		// Only unsorted windows follow the collection order
+		if o.order != nil && o.windowed && len(o.query.sort) == 0 {
+			o.diff()
+		}
+		return
+	case Reset:
+		o.matched = map[string]map[string]interface{}{}
+		if !o.windowed {
+			ids := make([]string, 0, len(o.visible))
+			for id := range o.visible {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				o.update(id)
+			}
+			return
+		}
+	default:
+		delete(o.matched, event.ID)
+		if event.After != nil {
+			o.match(event.ID, event.After)
+		}
+		if !o.windowed {
+			o.update(event.ID)
+			return
+		}
+	}
+	o.diff()
+}
+
+// reorder tracks the collection order.
+func (o *observer) reorder(event ChangeEvent) {
+	switch event.Kind {
+	case Added, Moved:
+		o.order, _ = insertBefore(removeID(o.order, event.ID), event.ID, event.BeforeID)
+	case Removed:
+		o.order = removeID(o.order, event.ID)
+	case Reset:
+		o.order = []string{}
+	}
+}
+
+// match adds a document to the matched documents if the query selects it.
+func (o *observer) match(id string, item interface{}) {
+	fields, _ := item.(map[string]interface{})
+	doc := documentWithID(id, fields)
+	if o.query.match(doc) {
+		o.matched[id] = doc
+	}
+}
+
+// view returns the projected document for a matched id, or nil.
+func (o *observer) view(id string) map[string]interface{} {
+	doc, ok := o.matched[id]
+	if !ok {
+		return nil
+	}
+	return o.query.project(documentWithID(id, doc))
+}
+
+// update reports the change, if any, to a single document in the results.
+func (o *observer) update(id string) {
+	before := o.visible[id]
+	after := o.view(id)
+	if after == nil {
+		delete(o.visible, id)
+	} else {
+		o.visible[id] = after
+	}
+	o.report(id, before, after, "")
+}
+
+// report emits the change from one version of a document in the results to
+// another.
+func (o *observer) report(id string, before, after map[string]interface{}, beforeID string) {
+	switch {
+	case before == nil && after == nil:
+	case before == nil:
+		o.emit(ChangeEvent{Kind: Added, ID: id, Fields: withoutID(after), BeforeID: beforeID, After: after})
+	case after == nil:
+		o.emit(ChangeEvent{Kind: Removed, ID: id, Before: before})
+	default:
+		fields, cleared := changedFields(before, after)
+		if len(fields) > 0 || len(cleared) > 0 {
+			o.emit(ChangeEvent{Kind: Changed, ID: id, Fields: fields, Cleared: cleared, Before: before, After: after})
+		}
+	}
+}
+
+// diff recomputes the results of a windowed observer and reports how they
+// changed. Ordered observers are sent the fewest moves needed.
+func (o *observer) diff() {
+	ids := o.query.window(o.order, o.matched)
+	included := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		included[id] = true
+	}
+	// Removed documents first, then changes to the ones that stay
+	kept := make([]string, 0, len(o.ids))
+	for _, id := range o.ids {
+		if included[id] {
+			kept = append(kept, id)
+			continue
+		}
+		o.report(id, o.visible[id], nil, "")
+		delete(o.visible, id)
+	}
+	for _, id := range kept {
+		o.update(id)
+	}
+	if !o.ordered {
+		for _, id := range ids {
+			if _, ok := o.visible[id]; !ok {
+				o.update(id)
+			}
+		}
+		o.ids = ids
+		return
+	}
+	// Documents in the longest run already in order stay put. Working
+	// back from the end, everything else is added or moved in front of
+	// the document that follows it.
+	stable := stableIDs(kept, ids)
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		if stable[id] {
+			continue
+		}
+		beforeID := ""
+		if i+1 < len(ids) {
+			beforeID = ids[i+1]
+		}
+		if doc, ok := o.visible[id]; ok {
+			o.emit(ChangeEvent{Kind: Moved, ID: id, BeforeID: beforeID, Before: doc, After: doc})
+			continue
+		}
+		doc := o.view(id)
+		o.visible[id] = doc
+		o.report(id, nil, doc, beforeID)
+	}
+	o.ids = ids
+}
+
+// stableIDs returns the largest set of ids from old that are in the same
+// relative order in ids.
+func stableIDs(old, ids []string) map[string]bool {
+	position := make(map[string]int, len(old))
+	for i, id := range old {
+		position[id] = i
+	}
+	// Longest increasing subsequence of old positions, in ids order
+	var seq []string
+	for _, id := range ids {
+		if _, ok := position[id]; ok {
+			seq = append(seq, id)
+		}
+	}
+	tails := []int{}
+	prev := make([]int, len(seq))
+	for i, id := range seq {
+		n := sort.Search(len(tails), func(j int) bool {
+			return position[seq[tails[j]]] >= position[id]
+		})
+		if n > 0 {
+			prev[i] = tails[n-1]
+		} else {
+			prev[i] = -1
+		}
+		if n == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[n] = i
+		}
+	}
+	stable := make(map[string]bool, len(tails))
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+			stable[seq[i]] = true
+		}
+	}
+	return stable
+}
+
+// changedFields returns the fields set and cleared going from one version
+// of a document to another, leaving out "_id".
+func changedFields(before, after map[string]interface{}) (map[string]interface{}, []string) {
+	fields := map[string]interface{}{}
+	for key, value := range after {
+		if old, ok := before[key]; key != "_id" && (!ok || !reflect.DeepEqual(old, value)) {
+			fields[key] = value
+		}
+	}
+	var cleared []string
+	for key := range before {
+		if _, ok := after[key]; !ok && key != "_id" {
+			cleared = append(cleared, key)
+		}
+	}
+	sort.Strings(cleared)
+	return fields, cleared
+}
+
+// withoutID returns a copy of a document without its "_id".
+func withoutID(doc map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		if key != "_id" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
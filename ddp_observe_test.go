@@ -0,0 +1,206 @@
+package ddp_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Live queries", func() {
+
+	var collection *KeyCache
+	var lock sync.Mutex
+	var calls []string
+
+	record := func(format string, args ...interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, fmt.Sprintf(format, args...))
+	}
+	recorded := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, calls...)
+	}
+	keys := func(fields map[string]interface{}) string {
+		keys := []string{}
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ",")
+	}
+	add := func(id string, fields map[string]interface{}) {
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": id, "fields": fields})
+	}
+	change := func(id string, fields map[string]interface{}, cleared ...interface{}) {
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": id, "fields": fields, "cleared": cleared})
+	}
+	remove := func(id string) {
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": id})
+	}
+	changes := ObserveChangesCallbacks{
+		Added: func(id string, fields map[string]interface{}) {
+			record("added %s %s", id, keys(fields))
+		},
+		Changed: func(id string, fields map[string]interface{}, cleared []string) {
+			record("changed %s %s -%s", id, keys(fields), strings.Join(cleared, ","))
+		},
+		Removed: func(id string) {
+			record("removed %s", id)
+		},
+	}
+	ordered := ObserveChangesCallbacks{
+		AddedBefore: func(id string, fields map[string]interface{}, before string) {
+			record("added %s before %q", id, before)
+		},
+		Changed: changes.Changed,
+		Removed: changes.Removed,
+		MovedBefore: func(id, before string) {
+			record("moved %s before %q", id, before)
+		},
+	}
+
+	BeforeEach(func() {
+		calls = nil
+		collection = NewCollection("builds").(*KeyCache)
+		add("a", map[string]interface{}{"status": "running", "duration": 30.0, "owner": "ci"})
+		add("b", map[string]interface{}{"status": "passed", "duration": 20.0})
+		add("c", map[string]interface{}{"status": "running", "duration": 10.0})
+	})
+
+	It("should report the initial results before returning", func() {
+		live, err := collection.Find(Selector{"status": "running"}, nil).ObserveChanges(changes)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer live.Stop()
+		Ω(recorded()).Should(Equal([]string{"added a duration,owner,status", "added c duration,status"}))
+	})
+
+	It("should report changes to matching documents only", func() {
+		live, err := collection.Find(Selector{"status": "running"}, &FindOptions{Fields: map[string]bool{"owner": false}}).ObserveChanges(changes)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer live.Stop()
+		calls = nil
+		change("b", map[string]interface{}{"duration": 25.0})
+		change("a", map[string]interface{}{"duration": 35.0})
+		// Changes to projected out fields aren't reported
+		change("a", map[string]interface{}{"owner": "me"})
+		change("b", map[string]interface{}{"status": "running"})
+		change("c", map[string]interface{}{"status": "passed"})
+		add("d", map[string]interface{}{"status": "queued"})
+		change("a", nil, "duration")
+		remove("b")
+		remove("d")
+		Eventually(recorded).Should(Equal([]string{
+			"changed a duration -",
+			"added b duration,status",
+			"removed c",
+			"changed a  -duration",
+			"removed b",
+		}))
+	})
+
+	It("should pass whole documents to Observe", func() {
+		var lock sync.Mutex
+		var docs [][]map[string]interface{}
+		live, err := collection.Find(Selector{"_id": "a"}, &FindOptions{Fields: map[string]bool{"status": true}}).Observe(ObserveCallbacks{
+			Added: func(doc map[string]interface{}) {
+				lock.Lock()
+				defer lock.Unlock()
+				docs = append(docs, []map[string]interface{}{doc})
+			},
+			Changed: func(newDoc, oldDoc map[string]interface{}) {
+				lock.Lock()
+				defer lock.Unlock()
+				docs = append(docs, []map[string]interface{}{newDoc, oldDoc})
+			},
+			Removed: func(oldDoc map[string]interface{}) {
+				lock.Lock()
+				defer lock.Unlock()
+				docs = append(docs, []map[string]interface{}{nil, oldDoc})
+			},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer live.Stop()
+		change("a", map[string]interface{}{"status": "passed"})
+		remove("a")
+		Eventually(func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(docs)
+		}).Should(Equal(3))
+		running := map[string]interface{}{"_id": "a", "status": "running"}
+		passed := map[string]interface{}{"_id": "a", "status": "passed"}
+		Ω(docs).Should(Equal([][]map[string]interface{}{{running}, {passed, running}, {nil, passed}}))
+	})
+
+	It("should report positions in ordered results", func() {
+		live, err := collection.Find(nil, &FindOptions{Sort: []SortField{{Field: "duration"}}}).ObserveChanges(ordered)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer live.Stop()
+		Ω(recorded()).Should(Equal([]string{`added c before ""`, `added b before ""`, `added a before ""`}))
+		calls = nil
+		// c b a -> b a c
+		change("c", map[string]interface{}{"duration": 40.0})
+		// b a c -> d b a c
+		add("d", map[string]interface{}{"duration": 5.0})
+		// d b a c -> d b c
+		remove("a")
+		Eventually(recorded).Should(Equal([]string{
+			"changed c duration -",
+			`moved c before ""`,
+			`added d before "b"`,
+			"removed a",
+		}))
+	})
+
+	It("should keep a limited window of results", func() {
+		live, err := collection.Find(nil, &FindOptions{Sort: []SortField{{Field: "duration", Descending: true}}, Limit: 2}).ObserveChanges(ordered)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer live.Stop()
+		Ω(recorded()).Should(Equal([]string{`added a before ""`, `added b before ""`}))
+		calls = nil
+		add("d", map[string]interface{}{"duration": 25.0})
+		remove("a")
+		Eventually(recorded).Should(Equal([]string{
+			"removed b",
+			`added d before ""`,
+			"removed a",
+			`added b before ""`,
+		}))
+	})
+
+	It("should remove everything on reset", func() {
+		live, err := collection.Find(Selector{"status": "running"}, nil).ObserveChanges(changes)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer live.Stop()
+		calls = nil
+		collection.Reset()
+		Eventually(recorded).Should(Equal([]string{"removed a", "removed c"}))
+	})
+
+	It("should stop", func() {
+		live, err := collection.Find(nil, nil).ObserveChanges(changes)
+		Ω(err).ShouldNot(HaveOccurred())
+		live.Stop()
+		calls = nil
+		add("d", nil)
+		Consistently(recorded).Should(BeEmpty())
+	})
+
+	It("should reject bad queries and callbacks", func() {
+		_, err := collection.Find(Selector{"$bad": 1}, nil).ObserveChanges(changes)
+		Ω(err).Should(HaveOccurred())
+		_, err = collection.Find(nil, nil).ObserveChanges(ObserveChangesCallbacks{
+			Added:       changes.Added,
+			AddedBefore: ordered.AddedBefore,
+		})
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,166 @@
+package ddp
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Option configures a Client created with Dial or DialContext.
+type Option func(*Client)
+
+// dialOptions holds the settings used to dial the server on every
+// connection.
+type dialOptions struct {
+	// header holds extra HTTP headers sent with the websocket handshake.
+	header http.Header
+	// tlsConfig configures TLS for wss:// servers.
+	tlsConfig *tls.Config
+	// dialer opens the network connection.
+	dialer *net.Dialer
+	// protocols are the websocket subprotocols offered to the server.
+	protocols []string
+	// proxy returns the URL of the HTTP proxy to tunnel through, if any.
+	proxy func(*http.Request) (*url.URL, error)
+	// sockJS wraps messages in SockJS frames.
+	sockJS bool
+	// transport replaces the default websocket dialer when set.
+	transport TransportDialer
+	// handshakeTimeout bounds each attempt to connect and complete the DDP
+	// handshake. Zero means no limit.
+	handshakeTimeout time.Duration
+}
+
+// WithOrigin sets the origin for the websocket connection. By default the
+// origin is the http(s) address of the server.
+func WithOrigin(origin string) Option {
+	return func(c *Client) {
+		c.origin = origin
+	}
+}
+
+// WithHeader adds HTTP headers to the websocket handshake, for example to
+// pass credentials to an authenticating proxy.
+func WithHeader(header http.Header) Option {
+	return func(c *Client) {
+		for key, values := range header {
+			for _, value := range values {
+				c.dialOptions.header.Add(key, value)
+			}
+		}
+	}
+}
+
+// WithCookies sends cookies with the websocket handshake.
+func WithCookies(cookies ...*http.Cookie) Option {
+	return func(c *Client) {
+		for _, cookie := range cookies {
+			c.dialOptions.header.Add("Cookie", cookie.String())
+		}
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for wss:// servers, for
+// example to present a client certificate or trust a private CA.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.dialOptions.tlsConfig = config
+	}
+}
+
+// WithDialer sets the dialer used to open network connections.
+func WithDialer(dialer *net.Dialer) Option {
+	return func(c *Client) {
+		c.dialOptions.dialer = dialer
+	}
+}
+
+// WithSubprotocols sets the websocket subprotocols offered to the server.
+func WithSubprotocols(protocols ...string) Option {
+	return func(c *Client) {
+		c.dialOptions.protocols = protocols
+	}
+}
+
+// WithProxy tunnels connections through the HTTP proxy returned by proxy
+// using CONNECT. A nil URL connects directly. Pass http.ProxyFromEnvironment
+// to honor the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) Option {
+	return func(c *Client) {
+		c.dialOptions.proxy = proxy
+	}
+}
+
+// WithTransport connects with dial instead of the default
+// golang.org/x/net/websocket dialer. The header, cookie, TLS, dialer,
+// subprotocol and proxy options only apply to the default dialer.
+func WithTransport(dial TransportDialer) Option {
+	return func(c *Client) {
+		c.dialOptions.transport = dial
+	}
+}
+
+// WithSockJS speaks SockJS framing to a SockJS websocket endpoint such as
+// ws://host/sockjs/123/abcdefgh/websocket. It is enabled automatically for
+// http(s) base URLs.
+func WithSockJS() Option {
+	return func(c *Client) {
+		c.dialOptions.sockJS = true
+	}
+}
+
+// WithHeartbeat sets the interval between heartbeat pings and how long to
+// wait for the server to answer before reconnecting.
+func WithHeartbeat(interval, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.HeartbeatInterval = interval
+		c.HeartbeatTimeout = timeout
+	}
+}
+
+// WithReconnectPolicy sets the policy deciding the delay between
+// reconnection attempts.
+func WithReconnectPolicy(policy ReconnectPolicy) Option {
+	return func(c *Client) {
+		c.ReconnectPolicy = policy
+	}
+}
+
+// WithMergeBox merges the data of the client's subscriptions on the client,
+// for servers that send every subscription's documents without merging
+// them. A document published by several subscriptions is then kept until
+// the last of them drops it, stopping a subscription removes the data only
+// it published, and KeyCache.Owners reports the subscriptions behind a
+// document. Servers that merge subscriptions themselves, as Meteor does,
+// don't say which subscriptions publish a document, so ownership can't be
+// known against them - don't use the option with such servers.
+func WithMergeBox() Option {
+	return func(c *Client) {
+		c.mergeBox = true
+	}
+}
+
+// WithHandshakeTimeout bounds each attempt to connect and complete the DDP
+// handshake. The default is 15 seconds; zero means no limit beyond the
+// context passed to DialContext.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.dialOptions.handshakeTimeout = timeout
+	}
+}
+
+// defaultOrigin derives an origin from a websocket URL by switching the
+// scheme to http(s) and dropping the path.
+func defaultOrigin(server string) string {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return "http://localhost/"
+	}
+	scheme := "http"
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + u.Host + "/"
+}
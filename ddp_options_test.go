@@ -0,0 +1,128 @@
+package ddp_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newConnectProxy starts an HTTP proxy that tunnels CONNECT requests,
+// counting the tunnels it opens.
+func newConnectProxy(tunnels *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Header.Get("Proxy-Authorization") == "" {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		atomic.AddInt32(tunnels, 1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
+
+var _ = Describe("Options", func() {
+
+	It("should send headers and cookies with the handshake", func() {
+		server := newTestServer(nil)
+		defer server.Close()
+		client, err := Dial(server.URL(),
+			WithHeader(http.Header{"Authorization": {"Bearer token"}}),
+			WithCookies(&http.Cookie{Name: "session", Value: "abc"}),
+		)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		headers := server.Headers()
+		Ω(headers).Should(HaveLen(1))
+		Ω(headers[0].Get("Authorization")).Should(Equal("Bearer token"))
+		Ω(headers[0].Get("Cookie")).Should(Equal("session=abc"))
+		Ω(headers[0].Get("Origin")).Should(Equal("http://" + server.Listener.Addr().String() + "/"))
+	})
+
+	It("should connect to a TLS server with a TLS config", func() {
+		server := newTLSTestServer(nil)
+		defer server.Close()
+		_, err := Dial(server.URL(), WithHandshakeTimeout(time.Second))
+		Ω(err).Should(HaveOccurred())
+
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		client, err := Dial(server.URL(), WithTLSConfig(&tls.Config{RootCAs: roots}))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(client.Session()).Should(Equal("test-session"))
+	})
+
+	It("should tunnel through a proxy", func() {
+		server := newTestServer(nil)
+		defer server.Close()
+		var tunnels int32
+		proxy := newConnectProxy(&tunnels)
+		defer proxy.Close()
+		proxyURL, _ := url.Parse(proxy.URL)
+		proxyURL.User = url.UserPassword("user", "secret")
+		client, err := Dial(server.URL(),
+			WithProxy(http.ProxyURL(proxyURL)),
+			WithReconnectPolicy(NewExponentialBackoff(10*time.Millisecond, 10*time.Millisecond)),
+		)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(atomic.LoadInt32(&tunnels)).Should(Equal(int32(1)))
+
+		// Reconnects use the proxy too
+		server.Drop()
+		Eventually(func() int32 { return atomic.LoadInt32(&tunnels) }, 2*time.Second).Should(Equal(int32(2)))
+	})
+
+	It("should report a proxy refusing the tunnel", func() {
+		server := newTestServer(nil)
+		defer server.Close()
+		var tunnels int32
+		proxy := newConnectProxy(&tunnels)
+		defer proxy.Close()
+		proxyURL, _ := url.Parse(proxy.URL)
+		_, err := Dial(server.URL(), WithProxy(http.ProxyURL(proxyURL)))
+		Ω(err).Should(MatchError(ContainSubstring("407")))
+	})
+
+	It("should configure heartbeats and reconnects", func() {
+		server := newTestServer(nil)
+		defer server.Close()
+		policy := NewExponentialBackoff(time.Millisecond, time.Second)
+		client, err := Dial(server.URL(),
+			WithHeartbeat(time.Second, 500*time.Millisecond),
+			WithReconnectPolicy(policy),
+			WithDialer(&net.Dialer{Timeout: time.Second}),
+		)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(client.HeartbeatInterval).Should(Equal(time.Second))
+		Ω(client.HeartbeatTimeout).Should(Equal(500 * time.Millisecond))
+		Ω(client.ReconnectPolicy).Should(BeIdenticalTo(policy))
+	})
+})
@@ -0,0 +1,998 @@
+package ddp
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+// Queries
+//
+// A subset of the Mongo query language (as implemented by Meteor's
+// minimongo) for searching cached documents:
+//
+//   {"field": value}                       - equality
+//   {"field": {"$eq": v, "$ne": v}}        - (in)equality
+//   {"field": {"$gt": v, "$gte": v, "$lt": v, "$lte": v}}
+//   {"field": {"$in": [...], "$nin": [...]}}
+//   {"field": {"$exists": true}}
+//   {"field": {"$regex": "^a", "$options": "i"}}
+//   {"field": {"$not": {...}}}
+//   {"field": {"$elemMatch": {...}}}
+//   {"$and": [...], "$or": [...], "$nor": [...]}
+//
+// Fields are dot-notation paths that descend into embedded documents and
+// arrays, and a field holding an array matches if any element does. The
+// document id is available as "_id".
+// ----------------------------------------------------------------------
+
+// Selector is a Mongo style query document. A nil or empty selector
+// matches every document.
+type Selector map[string]interface{}
+
+// SortField orders query results on a field.
+type SortField struct {
+	// Field is a dot-notation path.
+	Field string
+	// Descending reverses the order.
+	Descending bool
+}
+
+// FindOptions control the documents returned by Find.
+type FindOptions struct {
+	// Sort orders the results on each field in turn. Documents that
+	// compare equal keep the collection's order, which for unordered
+	// collections is by id.
+	Sort []SortField
+	// Skip is the number of matching documents to leave out.
+	Skip int
+	// Limit is the maximum number of documents returned, zero for all.
+	Limit int
+	// Fields projects the documents: true includes a dot-notation path and
+	// false excludes it. Inclusions and exclusions can't be mixed except to
+	// exclude "_id", which is otherwise always returned.
+	Fields map[string]bool
+}
+
+// Cursor iterates over the results of a query. The results are read from
+// the collection on first use. A cursor isn't safe for concurrent use.
+type Cursor struct {
+	collection Collection
+	query      *query
+	err        error
+	docs       []map[string]interface{}
+	fetched    bool
+	pos        int
+}
+
+// NewCursor compiles a query over any collection, reading its documents
+// with FindAll if it doesn't keep them in order. Errors in the query are
+// reported by the cursor's Err method.
+func NewCursor(collection Collection, selector Selector, opts *FindOptions) *Cursor {
+	q, err := compileQuery(selector, opts)
+	return &Cursor{collection: collection, query: q, err: err}
+}
+
+// Err returns the error, if any, in the query.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// fetch runs the query the first time results are needed.
+func (c *Cursor) fetch() {
+	if c.fetched || c.err != nil {
+		return
+	}
+	c.fetched = true
+	if source, ok := c.collection.(orderedSource); ok {
+		c.docs = c.query.run(source.snapshot())
+	} else {
+		c.docs = c.query.run(nil, c.collection.FindAll())
+	}
+}
+
+// orderedSource is implemented by collections that keep their items in
+// order.
+type orderedSource interface {
+	snapshot() ([]string, map[string]interface{})
+}
+
+// Count returns the number of documents in the results.
+func (c *Cursor) Count() int {
+	c.fetch()
+	return len(c.docs)
+}
+
+// All returns every document in the results. Documents are copies that
+// include their "_id".
+func (c *Cursor) All() []map[string]interface{} {
+	c.fetch()
+	return c.docs
+}
+
+// Next advances to the next document, returning false when there are no
+// more.
+func (c *Cursor) Next() bool {
+	c.fetch()
+	if c.pos >= len(c.docs) {
+		return false
+	}
+	c.pos++
+	return true
+}
+
+// Doc returns the current document.
+func (c *Cursor) Doc() map[string]interface{} {
+	if c.pos == 0 || c.pos > len(c.docs) {
+		return nil
+	}
+	return c.docs[c.pos-1]
+}
+
+// Decode decodes the current document into out, which must be a pointer.
+// EJSON values are converted so dates decode into time.Time and binary
+// into []byte.
+func (c *Cursor) Decode(out interface{}) error {
+	doc := c.Doc()
+	if doc == nil {
+		return fmt.Errorf("ddp: no current document")
+	}
+	return decodeEJSON(doc, out)
+}
+
+// query is a compiled selector and its options.
+type query struct {
+	match   matcher
+	sort    []SortField
+	skip    int
+	limit   int
+	project func(doc map[string]interface{}) map[string]interface{}
+}
+
+// compileQuery checks a selector and options and compiles them into a
+// query.
+func compileQuery(selector Selector, opts *FindOptions) (*query, error) {
+	if opts == nil {
+		opts = &FindOptions{}
+	}
+	match, err := compileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	project, err := compileProjection(opts.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Skip < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("ddp: negative skip or limit")
+	}
+	return &query{match: match, sort: opts.Sort, skip: opts.Skip, limit: opts.Limit, project: project}, nil
+}
+
+// run returns the matching documents from items, keyed by id, sorted and
+// projected. order lists the ids in collection order, or is nil.
+func (q *query) run(order []string, items map[string]interface{}) []map[string]interface{} {
+	matched := map[string]map[string]interface{}{}
+	for id, item := range items {
+		fields, _ := item.(map[string]interface{})
+		doc := documentWithID(id, fields)
+		if q.match(doc) {
+			matched[id] = doc
+		}
+	}
+	ids := q.window(order, matched)
+	docs := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		docs[i] = q.project(matched[id])
+	}
+	return docs
+}
+
+// window returns the ids of the matched documents in result order, after
+// skip and limit are applied. Without a sort the results are in collection
+// order, or by id if order is nil.
+func (q *query) window(order []string, matched map[string]map[string]interface{}) []string {
+	ids := make([]string, 0, len(matched))
+	if order != nil {
+		for _, id := range order {
+			if _, ok := matched[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+	} else {
+		for id := range matched {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+	if len(q.sort) > 0 {
+		sort.SliceStable(ids, func(i, j int) bool {
+			return q.less(matched[ids[i]], matched[ids[j]])
+		})
+	}
+	if q.skip >= len(ids) {
+		return ids[:0]
+	}
+	ids = ids[q.skip:]
+	if q.limit > 0 && q.limit < len(ids) {
+		ids = ids[:q.limit]
+	}
+	return ids
+}
+
+// less reports whether document a sorts before b.
+func (q *query) less(a, b map[string]interface{}) bool {
+	for _, field := range q.sort {
+		path := strings.Split(field.Field, ".")
+		cmp := compareValues(sortValue(lookupPath(a, path), field.Descending), sortValue(lookupPath(b, path), field.Descending))
+		if cmp == 0 {
+			continue
+		}
+		if field.Descending {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	return false
+}
+
+// documentWithID returns a copy of a document's fields with its "_id".
+func documentWithID(id string, fields map[string]interface{}) map[string]interface{} {
+	doc := make(map[string]interface{}, len(fields)+1)
+	for key, value := range fields {
+		doc[key] = value
+	}
+	doc["_id"] = id
+	return doc
+}
+
+// ----------------------------------------------------------------------
+// Selector matching
+// ----------------------------------------------------------------------
+
+// matcher reports whether a document matches a selector.
+type matcher func(doc map[string]interface{}) bool
+
+// valueMatcher reports whether the values found at a path match.
+type valueMatcher func(values []interface{}) bool
+
+// compileSelector compiles a selector into a matcher.
+func compileSelector(selector map[string]interface{}) (matcher, error) {
+	matchers := make([]matcher, 0, len(selector))
+	for key, value := range selector {
+		var m matcher
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(key, value)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("ddp: unknown query operator %s", key)
+			}
+			m, err = compileField(key, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileLogical compiles $and, $or and $nor, which take a list of
+// selectors.
+func compileLogical(op string, value interface{}) (matcher, error) {
+	list, ok := toList(value)
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("ddp: %s needs a non-empty array of selectors", op)
+	}
+	matchers := make([]matcher, len(list))
+	for i, item := range list {
+		selector, ok := toSelector(item)
+		if !ok {
+			return nil, fmt.Errorf("ddp: %s needs a non-empty array of selectors", op)
+		}
+		m, err := compileSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	return func(doc map[string]interface{}) bool {
+		matched := 0
+		for _, m := range matchers {
+			if m(doc) {
+				matched++
+			}
+		}
+		switch op {
+		case "$and":
+			return matched == len(matchers)
+		case "$or":
+			return matched > 0
+		default:
+			return matched == 0
+		}
+	}, nil
+}
+
+// compileField compiles the condition on a single field.
+func compileField(field string, spec interface{}) (matcher, error) {
+	path := strings.Split(field, ".")
+	var vm valueMatcher
+	var err error
+	if ops, ok := operatorDoc(spec); ok {
+		vm, err = compileOperators(ops)
+	} else {
+		vm, err = compileEquality(spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v (field %s)", err, field)
+	}
+	return func(doc map[string]interface{}) bool {
+		return vm(lookupPath(doc, path))
+	}, nil
+}
+
+// operatorDoc returns spec as a map if it is made up of operators.
+func operatorDoc(spec interface{}) (map[string]interface{}, bool) {
+	ops, ok := toSelector(spec)
+	if !ok || len(ops) == 0 {
+		return nil, false
+	}
+	for key := range ops {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+// compileEquality matches values equal to target. A regular expression
+// matches strings and nil matches missing fields.
+func compileEquality(target interface{}) (valueMatcher, error) {
+	if re, ok := target.(*regexp.Regexp); ok {
+		return anyValue(func(value interface{}) bool {
+			s, ok := value.(string)
+			return ok && re.MatchString(s)
+		}), nil
+	}
+	if target == nil {
+		return func(values []interface{}) bool {
+			if len(values) == 0 {
+				return true
+			}
+			return anyValue(func(value interface{}) bool { return value == nil })(values)
+		}, nil
+	}
+	return anyValue(func(value interface{}) bool { return equalValues(value, target) }), nil
+}
+
+// compileOperators compiles an operator document such as {"$gt": 1}.
+func compileOperators(ops map[string]interface{}) (valueMatcher, error) {
+	matchers := make([]valueMatcher, 0, len(ops))
+	for op, operand := range ops {
+		var vm valueMatcher
+		var err error
+		switch op {
+		case "$eq":
+			vm, err = compileEquality(operand)
+		case "$ne":
+			vm, err = compileEquality(operand)
+			vm = not(vm)
+		case "$gt", "$gte", "$lt", "$lte":
+			vm = compileComparison(op, operand)
+		case "$in", "$nin":
+			vm, err = compileIn(op, operand)
+			if op == "$nin" {
+				vm = not(vm)
+			}
+		case "$exists":
+			exists, ok := operand.(bool)
+			if !ok {
+				return nil, fmt.Errorf("ddp: $exists needs a boolean")
+			}
+			vm = func(values []interface{}) bool { return (len(values) > 0) == exists }
+		case "$regex":
+			vm, err = compileRegex(operand, ops["$options"])
+		case "$options":
+			if _, ok := ops["$regex"]; !ok {
+				return nil, fmt.Errorf("ddp: $options without $regex")
+			}
+			continue
+		case "$not":
+			vm, err = compileNot(operand)
+		case "$elemMatch":
+			vm, err = compileElemMatch(operand)
+		default:
+			return nil, fmt.Errorf("ddp: unknown query operator %s", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, vm)
+	}
+	return func(values []interface{}) bool {
+		for _, vm := range matchers {
+			if !vm(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileComparison compiles $gt, $gte, $lt and $lte. Only values of the
+// same type as the operand compare.
+func compileComparison(op string, operand interface{}) valueMatcher {
+	return anyValue(func(value interface{}) bool {
+		if typeRank(value) != typeRank(operand) {
+			return false
+		}
+		cmp := compareValues(value, operand)
+		switch op {
+		case "$gt":
+			return cmp > 0
+		case "$gte":
+			return cmp >= 0
+		case "$lt":
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	})
+}
+
+// compileIn compiles $in and $nin, which match any value in a list.
+func compileIn(op string, operand interface{}) (valueMatcher, error) {
+	list, ok := toList(operand)
+	if !ok {
+		return nil, fmt.Errorf("ddp: %s needs an array", op)
+	}
+	matchers := make([]valueMatcher, len(list))
+	for i, item := range list {
+		vm, err := compileEquality(item)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = vm
+	}
+	return func(values []interface{}) bool {
+		for _, vm := range matchers {
+			if vm(values) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// compileRegex compiles $regex with its optional $options flags.
+func compileRegex(operand, options interface{}) (valueMatcher, error) {
+	var pattern string
+	switch p := operand.(type) {
+	case string:
+		pattern = p
+	case *regexp.Regexp:
+		pattern = p.String()
+	default:
+		return nil, fmt.Errorf("ddp: $regex needs a string")
+	}
+	if options != nil {
+		flags, ok := options.(string)
+		if !ok {
+			return nil, fmt.Errorf("ddp: $options needs a string")
+		}
+		for _, flag := range flags {
+			if !strings.ContainsRune("ims", flag) {
+				return nil, fmt.Errorf("ddp: unsupported $regex option %q", flag)
+			}
+		}
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("ddp: bad $regex: %v", err)
+	}
+	return compileEquality(re)
+}
+
+// compileNot negates an operator document or regular expression.
+func compileNot(operand interface{}) (valueMatcher, error) {
+	if re, ok := operand.(*regexp.Regexp); ok {
+		vm, err := compileEquality(re)
+		return not(vm), err
+	}
+	ops, ok := operatorDoc(operand)
+	if !ok {
+		return nil, fmt.Errorf("ddp: $not needs an operator document or regular expression")
+	}
+	vm, err := compileOperators(ops)
+	if err != nil {
+		return nil, err
+	}
+	return not(vm), nil
+}
+
+// compileElemMatch matches arrays with an element that matches a selector,
+// or operators when the element isn't a document.
+func compileElemMatch(operand interface{}) (valueMatcher, error) {
+	var match func(element interface{}) bool
+	if ops, ok := operatorDoc(operand); ok && !isLogical(ops) {
+		vm, err := compileOperators(ops)
+		if err != nil {
+			return nil, err
+		}
+		match = func(element interface{}) bool { return vm([]interface{}{element}) }
+	} else {
+		selector, ok := toSelector(operand)
+		if !ok {
+			return nil, fmt.Errorf("ddp: $elemMatch needs a selector")
+		}
+		m, err := compileSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		match = func(element interface{}) bool {
+			doc, ok := element.(map[string]interface{})
+			return ok && m(doc)
+		}
+	}
+	return func(values []interface{}) bool {
+		for _, value := range values {
+			elements, ok := value.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, element := range elements {
+				if match(element) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// isLogical reports whether an operator document uses $and, $or or $nor.
+func isLogical(ops map[string]interface{}) bool {
+	for key := range ops {
+		if key == "$and" || key == "$or" || key == "$nor" {
+			return true
+		}
+	}
+	return false
+}
+
+// not negates a value matcher.
+func not(vm valueMatcher) valueMatcher {
+	return func(values []interface{}) bool { return !vm(values) }
+}
+
+// anyValue matches if test passes for any of the values or, for arrays,
+// any of their elements.
+func anyValue(test func(value interface{}) bool) valueMatcher {
+	return func(values []interface{}) bool {
+		for _, value := range values {
+			if test(value) {
+				return true
+			}
+			if elements, ok := value.([]interface{}); ok {
+				for _, element := range elements {
+					if test(element) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+// lookupPath returns the values at a dot-notation path. Arrays along the
+// path are indexed by number or searched element by element, so there may
+// be several values. A path that doesn't exist has none.
+func lookupPath(value interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		next, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookupPath(next, path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return lookupPath(v[i], path[1:])
+		}
+		var values []interface{}
+		for _, element := range v {
+			if _, ok := element.(map[string]interface{}); ok {
+				values = append(values, lookupPath(element, path)...)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// ----------------------------------------------------------------------
+// Values
+// ----------------------------------------------------------------------
+
+// toSelector returns value as a selector if it is an object.
+func toSelector(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case Selector:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// toList returns the elements of any slice or array.
+func toList(value interface{}) ([]interface{}, bool) {
+	if list, ok := value.([]interface{}); ok {
+		return list, true
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, false
+	}
+	list := make([]interface{}, v.Len())
+	for i := range list {
+		list[i] = v.Index(i).Interface()
+	}
+	return list, true
+}
+
+// toNumber returns any Go number as a float64.
+func toNumber(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// toTime returns EJSON dates and time.Time values as a time.
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return time.Time{}, false
+		}
+		if ms, ok := toNumber(v["$date"]); ok {
+			return time.Unix(0, int64(ms)*int64(time.Millisecond)), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// typeRank orders values of different types the way Mongo sorts them.
+func typeRank(value interface{}) int {
+	if value == nil {
+		return 1
+	}
+	if _, ok := toNumber(value); ok {
+		return 2
+	}
+	if _, ok := toTime(value); ok {
+		return 9
+	}
+	switch value.(type) {
+	case string:
+		return 3
+	case map[string]interface{}, Selector:
+		return 4
+	case []interface{}:
+		return 5
+	case bool:
+		return 8
+	default:
+		if _, ok := toList(value); ok {
+			return 5
+		}
+		return 10
+	}
+}
+
+// compareValues orders two values, first by type then by value. Documents
+// and arrays compare element by element.
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInts(ra, rb)
+	}
+	switch ra {
+	case 2:
+		x, _ := toNumber(a)
+		y, _ := toNumber(b)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case 3:
+		return strings.Compare(a.(string), b.(string))
+	case 4:
+		x, _ := toSelector(a)
+		y, _ := toSelector(b)
+		return compareDocs(x, y)
+	case 5:
+		x, _ := toList(a)
+		y, _ := toList(b)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if cmp := compareValues(x[i], y[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		return compareInts(len(x), len(y))
+	case 8:
+		return compareInts(boolInt(a.(bool)), boolInt(b.(bool)))
+	case 9:
+		x, _ := toTime(a)
+		y, _ := toTime(b)
+		if x.Before(y) {
+			return -1
+		} else if x.After(y) {
+			return 1
+		}
+		return 0
+	default:
+		return 0
+	}
+}
+
+// compareDocs orders documents by their keys, sorted, then values.
+func compareDocs(a, b map[string]interface{}) int {
+	keys := func(doc map[string]interface{}) []string {
+		keys := make([]string, 0, len(doc))
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	ka, kb := keys(a), keys(b)
+	for i := 0; i < len(ka) && i < len(kb); i++ {
+		if cmp := strings.Compare(ka[i], kb[i]); cmp != 0 {
+			return cmp
+		}
+		if cmp := compareValues(a[ka[i]], b[kb[i]]); cmp != 0 {
+			return cmp
+		}
+	}
+	return compareInts(len(ka), len(kb))
+}
+
+// equalValues reports whether two values are equal, treating all number
+// types alike.
+func equalValues(a, b interface{}) bool {
+	if typeRank(a) != typeRank(b) {
+		return false
+	}
+	if typeRank(a) == 10 {
+		return reflect.DeepEqual(a, b)
+	}
+	return compareValues(a, b) == 0
+}
+
+// sortValue picks the value a document sorts on from the values at the
+// sort path: the smallest ascending and the largest descending, looking
+// inside arrays.
+func sortValue(values []interface{}, descending bool) interface{} {
+	var candidates []interface{}
+	for _, value := range values {
+		if elements, ok := value.([]interface{}); ok && len(elements) > 0 {
+			candidates = append(candidates, elements...)
+		} else {
+			candidates = append(candidates, value)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		cmp := compareValues(candidate, best)
+		if (descending && cmp > 0) || (!descending && cmp < 0) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ----------------------------------------------------------------------
+// Projections
+// ----------------------------------------------------------------------
+
+// projection is a tree of projected paths. A nil subtree projects the
+// whole value.
+type projection map[string]projection
+
+// compileProjection compiles a fields specification into a function that
+// projects a document.
+func compileProjection(fields map[string]bool) (func(map[string]interface{}) map[string]interface{}, error) {
+	includeID := true
+	tree := projection{}
+	var include, exclude bool
+	for field, included := range fields {
+		if field == "_id" {
+			includeID = included
+			continue
+		}
+		if included {
+			include = true
+		} else {
+			exclude = true
+		}
+		if include && exclude {
+			return nil, fmt.Errorf("ddp: projection can't both include and exclude fields")
+		}
+		tree.add(strings.Split(field, "."))
+	}
+	// Documents are copies made for the query so they can be modified
+	return func(doc map[string]interface{}) map[string]interface{} {
+		switch {
+		case include:
+			out := tree.include(doc)
+			if includeID {
+				out["_id"] = doc["_id"]
+			}
+			return out
+		case exclude:
+			doc = tree.exclude(doc)
+		}
+		if !includeID {
+			delete(doc, "_id")
+		}
+		return doc
+	}, nil
+}
+
+// add adds a path to the tree. A shorter path wins over a longer one.
+func (p projection) add(path []string) {
+	sub, ok := p[path[0]]
+	if len(path) == 1 {
+		p[path[0]] = nil
+		return
+	}
+	if ok && sub == nil {
+		return
+	}
+	if !ok {
+		sub = projection{}
+		p[path[0]] = sub
+	}
+	sub.add(path[1:])
+}
+
+// include returns a copy of doc with only the paths in the tree.
+func (p projection) include(doc map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for key, sub := range p {
+		value, ok := doc[key]
+		if !ok {
+			continue
+		}
+		if sub == nil {
+			out[key] = value
+			continue
+		}
+		if projected, ok := sub.apply(value, sub.include, false); ok {
+			out[key] = projected
+		}
+	}
+	return out
+}
+
+// exclude returns a copy of doc without the paths in the tree.
+func (p projection) exclude(doc map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		sub, ok := p[key]
+		if !ok {
+			out[key] = value
+			continue
+		}
+		if sub == nil {
+			continue
+		}
+		if projected, ok := sub.apply(value, sub.exclude, true); ok {
+			out[key] = projected
+		} else {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// apply projects an embedded document, or each document in an array.
+// Other array elements are kept if keep is true.
+func (p projection) apply(value interface{}, project func(map[string]interface{}) map[string]interface{}, keep bool) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return project(v), true
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			if doc, ok := element.(map[string]interface{}); ok {
+				out = append(out, project(doc))
+			} else if keep {
+				out = append(out, element)
+			}
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
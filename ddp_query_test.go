@@ -0,0 +1,210 @@
+package ddp_test
+
+import (
+	"regexp"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Find", func() {
+
+	var collection *KeyCache
+
+	ids := func(cursor *Cursor) []string {
+		Ω(cursor.Err()).ShouldNot(HaveOccurred())
+		ids := []string{}
+		for cursor.Next() {
+			ids = append(ids, cursor.Doc()["_id"].(string))
+		}
+		return ids
+	}
+	find := func(selector Selector) []string {
+		return ids(collection.Find(selector, nil))
+	}
+
+	BeforeEach(func() {
+		collection = NewCollection("builds").(*KeyCache)
+		for id, fields := range map[string]map[string]interface{}{
+			"a": {"name": "nightly", "status": "passed", "duration": 120.0, "tags": []interface{}{"ci", "slow"},
+				"repo": map[string]interface{}{"owner": "gopackage", "stars": 10.0},
+				"steps": []interface{}{
+					map[string]interface{}{"name": "build", "ok": true},
+					map[string]interface{}{"name": "test", "ok": true},
+				},
+				"started": map[string]interface{}{"$date": 1500000000000.0},
+			},
+			"b": {"name": "Release", "status": "failed", "duration": 300.0, "tags": []interface{}{"release"},
+				"repo": map[string]interface{}{"owner": "meteor", "stars": 50.0},
+				"steps": []interface{}{
+					map[string]interface{}{"name": "build", "ok": true},
+					map[string]interface{}{"name": "test", "ok": false},
+				},
+				"started": map[string]interface{}{"$date": 1600000000000.0},
+			},
+			"c": {"name": "pr-42", "status": "running", "duration": 45.0, "owner": nil,
+				"repo": map[string]interface{}{"owner": "gopackage", "stars": 10.0},
+			},
+		} {
+			collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": id, "fields": fields})
+		}
+	})
+
+	It("should match everything with an empty selector", func() {
+		Ω(find(nil)).Should(Equal([]string{"a", "b", "c"}))
+		Ω(collection.Find(Selector{}, nil).Count()).Should(Equal(3))
+	})
+
+	It("should match on equality", func() {
+		Ω(find(Selector{"status": "failed"})).Should(Equal([]string{"b"}))
+		Ω(find(Selector{"_id": "c"})).Should(Equal([]string{"c"}))
+		Ω(find(Selector{"duration": 120})).Should(Equal([]string{"a"}))
+		Ω(find(Selector{"status": "passed", "duration": 300})).Should(BeEmpty())
+	})
+
+	It("should match on dot-notation paths", func() {
+		Ω(find(Selector{"repo.owner": "gopackage"})).Should(Equal([]string{"a", "c"}))
+		Ω(find(Selector{"steps.name": "test"})).Should(Equal([]string{"a", "b"}))
+		Ω(find(Selector{"steps.1.ok": false})).Should(Equal([]string{"b"}))
+		Ω(find(Selector{"repo": map[string]interface{}{"owner": "meteor", "stars": 50}})).Should(Equal([]string{"b"}))
+	})
+
+	It("should match embedded documents written as selectors", func() {
+		Ω(find(Selector{"repo": Selector{"owner": "meteor", "stars": 50}})).Should(Equal([]string{"b"}))
+		Ω(find(Selector{"repo": Selector{"$eq": Selector{"owner": "gopackage", "stars": 10}}})).Should(Equal([]string{"a", "c"}))
+		Ω(find(Selector{"steps": Selector{"$in": []interface{}{Selector{"name": "test", "ok": false}}}})).Should(Equal([]string{"b"}))
+	})
+
+	It("should match array elements", func() {
+		Ω(find(Selector{"tags": "ci"})).Should(Equal([]string{"a"}))
+		Ω(find(Selector{"tags": []interface{}{"release"}})).Should(Equal([]string{"b"}))
+	})
+
+	It("should compare values", func() {
+		Ω(find(Selector{"duration": Selector{"$gt": 100}})).Should(Equal([]string{"a", "b"}))
+		Ω(find(Selector{"duration": Selector{"$gte": 45, "$lt": 300}})).Should(Equal([]string{"a", "c"}))
+		Ω(find(Selector{"duration": Selector{"$lte": 120.0}})).Should(Equal([]string{"a", "c"}))
+		Ω(find(Selector{"name": Selector{"$gt": "n"}})).Should(Equal([]string{"a", "c"}))
+		Ω(find(Selector{"name": Selector{"$gt": 1}})).Should(BeEmpty())
+		Ω(find(Selector{"started": Selector{"$gt": time.Unix(1550000000, 0)}})).Should(Equal([]string{"b"}))
+	})
+
+	It("should match $eq and $ne", func() {
+		Ω(find(Selector{"status": Selector{"$eq": "running"}})).Should(Equal([]string{"c"}))
+		Ω(find(Selector{"status": Selector{"$ne": "running"}})).Should(Equal([]string{"a", "b"}))
+		Ω(find(Selector{"tags": Selector{"$ne": "ci"}})).Should(Equal([]string{"b", "c"}))
+	})
+
+	It("should match $in and $nin", func() {
+		Ω(find(Selector{"status": Selector{"$in": []string{"passed", "running"}}})).Should(Equal([]string{"a", "c"}))
+		Ω(find(Selector{"tags": Selector{"$in": []interface{}{"slow", "release"}}})).Should(Equal([]string{"a", "b"}))
+		Ω(find(Selector{"status": Selector{"$nin": []string{"passed", "running"}}})).Should(Equal([]string{"b"}))
+	})
+
+	It("should match $exists and null", func() {
+		Ω(find(Selector{"tags": Selector{"$exists": true}})).Should(Equal([]string{"a", "b"}))
+		Ω(find(Selector{"tags": Selector{"$exists": false}})).Should(Equal([]string{"c"}))
+		Ω(find(Selector{"owner": nil})).Should(Equal([]string{"a", "b", "c"}))
+		Ω(find(Selector{"owner": Selector{"$exists": true}})).Should(Equal([]string{"c"}))
+	})
+
+	It("should match regular expressions", func() {
+		Ω(find(Selector{"name": Selector{"$regex": "^r"}})).Should(BeEmpty())
+		Ω(find(Selector{"name": Selector{"$regex": "^r", "$options": "i"}})).Should(Equal([]string{"b"}))
+		Ω(find(Selector{"name": regexp.MustCompile(`\d+$`)})).Should(Equal([]string{"c"}))
+		Ω(find(Selector{"tags": Selector{"$regex": "^sl"}})).Should(Equal([]string{"a"}))
+	})
+
+	It("should match logical operators", func() {
+		Ω(find(Selector{"$or": []interface{}{
+			Selector{"status": "failed"},
+			Selector{"duration": Selector{"$lt": 60}},
+		}})).Should(Equal([]string{"b", "c"}))
+		Ω(find(Selector{"$and": []Selector{
+			{"repo.owner": "gopackage"},
+			{"status": Selector{"$ne": "running"}},
+		}})).Should(Equal([]string{"a"}))
+		Ω(find(Selector{"$nor": []Selector{{"status": "failed"}, {"status": "running"}}})).Should(Equal([]string{"a"}))
+		Ω(find(Selector{"duration": Selector{"$not": Selector{"$gt": 100}}})).Should(Equal([]string{"c"}))
+		Ω(find(Selector{"name": Selector{"$not": regexp.MustCompile("^n")}})).Should(Equal([]string{"b", "c"}))
+	})
+
+	It("should match $elemMatch", func() {
+		Ω(find(Selector{"steps": Selector{"$elemMatch": Selector{"name": "test", "ok": true}}})).Should(Equal([]string{"a"}))
+		// Without $elemMatch the conditions may match different elements
+		Ω(find(Selector{"steps.name": "test", "steps.ok": false})).Should(Equal([]string{"b"}))
+		Ω(find(Selector{"steps": Selector{"$elemMatch": Selector{"name": "build", "ok": false}}})).Should(BeEmpty())
+		Ω(find(Selector{"tags": Selector{"$elemMatch": Selector{"$regex": "^rel"}}})).Should(Equal([]string{"b"}))
+	})
+
+	It("should report bad selectors", func() {
+		for _, selector := range []Selector{
+			{"$where": "true"},
+			{"status": Selector{"$like": "a"}},
+			{"status": Selector{"$in": "passed"}},
+			{"status": Selector{"$exists": 1}},
+			{"name": Selector{"$regex": "("}},
+			{"name": Selector{"$options": "i"}},
+			{"$or": []interface{}{}},
+		} {
+			cursor := collection.Find(selector, nil)
+			Ω(cursor.Err()).Should(HaveOccurred(), "%v", selector)
+			Ω(cursor.Next()).Should(BeFalse())
+			Ω(cursor.All()).Should(BeEmpty())
+		}
+		cursor := collection.Find(nil, &FindOptions{Fields: map[string]bool{"name": true, "status": false}})
+		Ω(cursor.Err()).Should(MatchError(ContainSubstring("include and exclude")))
+	})
+
+	It("should sort, skip and limit", func() {
+		Ω(ids(collection.Find(nil, &FindOptions{Sort: []SortField{{Field: "duration"}}}))).Should(Equal([]string{"c", "a", "b"}))
+		Ω(ids(collection.Find(nil, &FindOptions{Sort: []SortField{{Field: "repo.stars", Descending: true}}}))).Should(Equal([]string{"b", "a", "c"}))
+		Ω(ids(collection.Find(nil, &FindOptions{Sort: []SortField{{Field: "repo.owner"}, {Field: "name", Descending: true}}}))).Should(Equal([]string{"c", "a", "b"}))
+		Ω(ids(collection.Find(nil, &FindOptions{Sort: []SortField{{Field: "started", Descending: true}}}))).Should(Equal([]string{"b", "a", "c"}))
+		Ω(ids(collection.Find(nil, &FindOptions{Sort: []SortField{{Field: "duration"}}, Skip: 1, Limit: 1}))).Should(Equal([]string{"a"}))
+		Ω(collection.Find(nil, &FindOptions{Skip: 5}).Count()).Should(BeZero())
+	})
+
+	It("should project fields", func() {
+		docs := collection.Find(Selector{"_id": "a"}, &FindOptions{Fields: map[string]bool{"name": true, "repo.owner": true, "steps.name": true}}).All()
+		Ω(docs).Should(Equal([]map[string]interface{}{{
+			"_id":  "a",
+			"name": "nightly",
+			"repo": map[string]interface{}{"owner": "gopackage"},
+			"steps": []interface{}{
+				map[string]interface{}{"name": "build"},
+				map[string]interface{}{"name": "test"},
+			},
+		}}))
+		docs = collection.Find(Selector{"_id": "c"}, &FindOptions{Fields: map[string]bool{"_id": false, "repo.stars": false, "owner": false, "duration": false}}).All()
+		Ω(docs).Should(Equal([]map[string]interface{}{{
+			"name":   "pr-42",
+			"status": "running",
+			"repo":   map[string]interface{}{"owner": "gopackage"},
+		}}))
+		// The cached documents are untouched
+		Ω(collection.FindOne("c")).Should(HaveKey("duration"))
+		Ω(collection.FindOne("c")).ShouldNot(HaveKey("_id"))
+	})
+
+	It("should decode documents", func() {
+		cursor := collection.Find(Selector{"_id": "a"}, nil)
+		Ω(cursor.Decode(&struct{}{})).Should(HaveOccurred())
+		Ω(cursor.Next()).Should(BeTrue())
+		var build struct {
+			ID       string    `json:"_id"`
+			Name     string    `json:"name"`
+			Duration int       `json:"duration"`
+			Started  time.Time `json:"started"`
+		}
+		Ω(cursor.Decode(&build)).Should(Succeed())
+		Ω(build.ID).Should(Equal("a"))
+		Ω(build.Name).Should(Equal("nightly"))
+		Ω(build.Duration).Should(Equal(120))
+		Ω(build.Started.Equal(time.Unix(1500000000, 0))).Should(BeTrue())
+		Ω(cursor.Next()).Should(BeFalse())
+	})
+})
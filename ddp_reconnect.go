@@ -0,0 +1,281 @@
+package ddp
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// ReconnectPolicy decides how long the client waits before each attempt to
+// reconnect to the server.
+type ReconnectPolicy interface {
+	// Backoff returns the delay before the given reconnect attempt, counting
+	// from 1. Returning false stops the client from reconnecting.
+	Backoff(attempt int) (time.Duration, bool)
+}
+
+// ExponentialBackoff is a ReconnectPolicy that increases the delay between
+// attempts exponentially, with random jitter so many clients that lose a
+// server at the same time don't reconnect in lockstep.
+type ExponentialBackoff struct {
+	// Initial is the delay before the first attempt.
+	Initial time.Duration
+	// Max caps the delay between attempts. Zero means no cap.
+	Max time.Duration
+	// Multiplier is the growth factor between attempts.
+	Multiplier float64
+	// Jitter is the fraction of the delay that is randomized. A jitter of
+	// 0.5 spreads a 10s delay evenly between 7.5s and 12.5s.
+	Jitter float64
+	// MaxAttempts is the number of attempts before giving up. Zero means
+	// retry forever.
+	MaxAttempts int
+}
+
+// NewExponentialBackoff creates a policy that doubles the delay after each
+// attempt, from initial up to max, with 50% jitter and no attempt limit.
+func NewExponentialBackoff(initial, max time.Duration) *ExponentialBackoff {
+	return &ExponentialBackoff{
+		Initial:    initial,
+		Max:        max,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+}
+
+// Backoff implements the ReconnectPolicy interface.
+func (b *ExponentialBackoff) Backoff(attempt int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt > b.MaxAttempts {
+		return 0, false
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if b.Jitter > 0 {
+		delay *= 1 - b.Jitter/2 + b.Jitter*rand.Float64()
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	return time.Duration(delay), true
+}
+
+// ----------------------------------------------------------------------
+// Resynchronizing collections
+//
+// After a reconnect the server sends the data of every resent subscription
+// again. Rather than wiping the collections and refilling them, the client
+// keeps the old documents and buffers the new data until it is complete -
+// every resent subscription is ready and every resent method has its
+// writes in (quiescence, as Meteor calls it). The collections are then
+// patched with the difference so listeners only see real changes.
+// ----------------------------------------------------------------------
+
+// resync tracks the data the client is waiting for after a reconnect.
+type resync struct {
+	// subs are the resent subscriptions that aren't ready yet.
+	subs map[string]bool
+	// methods are the resent methods whose writes aren't in yet.
+	methods map[string]bool
+	// buffer holds the data messages received on the new connection.
+	buffer []*inboxEvent
+	// after holds functions to run once the collections are patched.
+	after []func()
+}
+
+// beginResync starts waiting for resent data, keeping the functions that
+// an interrupted resync was going to run. The caller must hold the lock.
+func (c *Client) beginResync() *resync {
+	r := &resync{subs: map[string]bool{}, methods: map[string]bool{}}
+	if c.resync != nil {
+		r.after = c.resync.after
+	}
+	c.resync = r
+	return r
+}
+
+// whenResynced runs fn now, or after the collections are patched if the
+// client is waiting for resent data.
+func (c *Client) whenResynced(fn func()) {
+	c.lock.Lock()
+	if r := c.resync; r != nil {
+		r.after = append(r.after, fn)
+		c.lock.Unlock()
+		return
+	}
+	c.lock.Unlock()
+	fn()
+}
+
+// bufferResync holds back a data message while the client is waiting for
+// resent data, returning false if it should be applied now. Messages from
+// earlier connections are dropped - the new connection sends them again.
+func (c *Client) bufferResync(event *inboxEvent) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r := c.resync
+	if r == nil {
+		return false
+	}
+	if event.conn == c.conn {
+		r.buffer = append(r.buffer, event)
+	}
+	return true
+}
+
+// settleResync records subscriptions that are ready (or stopped) and
+// methods whose writes are in, patching the collections once nothing is
+// left to wait for.
+func (c *Client) settleResync(subs, methods []string) {
+	c.lock.Lock()
+	r := c.resync
+	if r == nil {
+		c.lock.Unlock()
+		return
+	}
+	for _, id := range subs {
+		delete(r.subs, id)
+	}
+	for _, id := range methods {
+		delete(r.methods, id)
+	}
+	if len(r.subs) > 0 || len(r.methods) > 0 {
+		c.lock.Unlock()
+		return
+	}
+	c.resync = nil
+	c.lock.Unlock()
+	c.finishResync(r)
+}
+
+// finishResync applies the buffered data to copies of the collections as
+// they would be on a fresh connection, and patches the collections to
+// match.
+func (c *Client) finishResync(r *resync) {
+	shadows := map[string]Collection{}
+	shadowFor := func(name string, makeDefault func(string) Collection) Collection {
+		if shadow, ok := shadows[name]; ok {
+			return shadow
+		}
+		shadow := newShadow(c.CollectionByNameWithDefault(name, makeDefault), name)
+		c.lock.Lock()
+		handlers := c.consistencyHandlers
+		c.lock.Unlock()
+		if reporter, ok := shadow.(consistencyReporter); ok {
+			for _, handler := range handlers {
+				reporter.OnConsistencyError(handler)
+			}
+		}
+		shadows[name] = shadow
+		return shadow
+	}
+	for _, event := range r.buffer {
+		applyData(event, shadowFor)
+	}
+
+	c.lock.Lock()
+	names := make([]string, 0, len(c.collections))
+	collections := make(map[string]Collection, len(c.collections))
+	for name, collection := range c.collections {
+		names = append(names, name)
+		collections[name] = collection
+	}
+	c.lock.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		shadow, ok := shadows[name]
+		if !ok {
+			shadow = newShadow(collections[name], name)
+		}
+		reconcile(name, collections[name], shadow)
+		// The shadow knows who published the resent data
+		live, ok := collections[name].(merger)
+		if source, sourceOK := shadow.(merger); ok && sourceOK && c.mergeBox {
+			live.adoptMerged(source.mergedDocs())
+		}
+	}
+	log.WithField("messages", len(r.buffer)).WithField("collections", len(names)).Info("Collections resynchronized after reconnect")
+	for _, fn := range r.after {
+		fn()
+	}
+}
+
+// newShadow creates an empty collection of the same kind as live.
+func newShadow(live Collection, name string) Collection {
+	if _, ok := live.(*OrderedCache); ok {
+		return NewOrderedCollection(name)
+	}
+	return NewCollection(name)
+}
+
+// orderedIDs is implemented by collections that keep their items in order.
+type orderedIDs interface {
+	IDs() []string
+}
+
+// reconcile sends live the messages that turn its documents into those of
+// target.
+func reconcile(name string, live, target Collection) {
+	before, after := live.FindAll(), target.FindAll()
+	for _, id := range sortedIDs(before) {
+		if _, ok := after[id]; !ok {
+			live.Removed(map[string]interface{}{"msg": "removed", "collection": name, "id": id})
+		}
+	}
+	for _, id := range sortedIDs(after) {
+		old, ok := before[id]
+		if !ok {
+			continue
+		}
+		oldFields, _ := old.(map[string]interface{})
+		newFields, _ := after[id].(map[string]interface{})
+		fields, cleared := changedFields(oldFields, newFields)
+		if len(fields) == 0 && len(cleared) == 0 {
+			continue
+		}
+		live.Changed(changedMessage(name, id, fields, cleared))
+	}
+
+	liveOrder, ok := live.(orderedIDs)
+	targetOrder, targetOK := target.(orderedIDs)
+	if !ok || !targetOK {
+		for _, id := range sortedIDs(after) {
+			if _, ok := before[id]; !ok {
+				live.Added(map[string]interface{}{"msg": "added", "collection": name, "id": id, "fields": after[id]})
+			}
+		}
+		return
+	}
+	// Working back from the end, add or move everything that isn't already
+	// in order in front of the document that follows it
+	order := targetOrder.IDs()
+	stable := stableIDs(liveOrder.IDs(), order)
+	for i := len(order) - 1; i >= 0; i-- {
+		id := order[i]
+		if stable[id] {
+			continue
+		}
+		var beforeID interface{}
+		if i+1 < len(order) {
+			beforeID = order[i+1]
+		}
+		if _, ok := before[id]; ok {
+			live.MovedBefore(map[string]interface{}{"msg": "movedBefore", "collection": name, "id": id, "before": beforeID})
+		} else {
+			live.AddedBefore(map[string]interface{}{"msg": "addedBefore", "collection": name, "id": id, "fields": after[id], "before": beforeID})
+		}
+	}
+}
+
+// sortedIDs returns the keys of items in order.
+func sortedIDs(items map[string]interface{}) []string {
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
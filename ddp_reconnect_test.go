@@ -0,0 +1,286 @@
+package ddp_test
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconnect", func() {
+
+	Describe("ExponentialBackoff", func() {
+
+		It("should grow exponentially up to the max", func() {
+			policy := &ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+			for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+				delay, ok := policy.Backoff(attempt + 1)
+				Ω(ok).Should(BeTrue())
+				Ω(delay).Should(Equal(expected))
+			}
+		})
+
+		It("should add jitter", func() {
+			policy := NewExponentialBackoff(10*time.Second, time.Minute)
+			seen := map[time.Duration]bool{}
+			for i := 0; i < 20; i++ {
+				delay, ok := policy.Backoff(1)
+				Ω(ok).Should(BeTrue())
+				Ω(delay).Should(BeNumerically(">=", 7500*time.Millisecond))
+				Ω(delay).Should(BeNumerically("<=", 12500*time.Millisecond))
+				seen[delay] = true
+			}
+			Ω(len(seen)).Should(BeNumerically(">", 1))
+		})
+
+		It("should never exceed the max with jitter", func() {
+			policy := NewExponentialBackoff(time.Second, 5*time.Second)
+			for i := 0; i < 20; i++ {
+				delay, _ := policy.Backoff(10)
+				Ω(delay).Should(BeNumerically("<=", 5*time.Second))
+			}
+		})
+
+		It("should give up after the max attempts", func() {
+			policy := NewExponentialBackoff(time.Second, time.Minute)
+			policy.MaxAttempts = 3
+			_, ok := policy.Backoff(3)
+			Ω(ok).Should(BeTrue())
+			_, ok = policy.Backoff(4)
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Describe("Client", func() {
+
+		var server *testServer
+		var client *Client
+
+		BeforeEach(func() {
+			server = newTestServer(nil)
+			var err error
+			client, err = NewClient(server.URL(), "http://localhost/")
+			Ω(err).ShouldNot(HaveOccurred())
+			client.ReconnectPolicy = &ExponentialBackoff{Initial: 10 * time.Millisecond, Multiplier: 2}
+			Eventually(client.Session).ShouldNot(BeEmpty())
+		})
+
+		AfterEach(func() {
+			client.Close()
+			server.Close()
+		})
+
+		It("should reconnect once after a dropped connection", func() {
+			server.Drop()
+			Eventually(func() int { return len(server.Received("connect")) }).Should(Equal(2))
+			Consistently(func() int { return len(server.Received("connect")) }, 200*time.Millisecond).Should(Equal(2))
+			Ω(client.Stats().Reconnects).Should(Equal(int64(1)))
+			Ω(server.Received("connect")[1]["session"]).Should(Equal("test-session"))
+		})
+
+		It("should back off while the server is down", func() {
+			server.Shutdown()
+			Eventually(func() int64 { return client.Stats().Reconnects }).Should(BeNumerically(">=", 3))
+			// Delays double so attempts slow down rather than hammer the server
+			Consistently(func() int64 { return client.Stats().Reconnects }, 100*time.Millisecond).Should(BeNumerically("<", 10))
+		})
+
+		It("should give up after the max attempts", func() {
+			client.ReconnectPolicy = &ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 2}
+			server.Shutdown()
+			Eventually(func() int64 { return client.Stats().Reconnects }).Should(Equal(int64(2)))
+			Consistently(func() int64 { return client.Stats().Reconnects }, 100*time.Millisecond).Should(Equal(int64(2)))
+		})
+
+		It("should not reconnect after close", func() {
+			client.Close()
+			Consistently(func() int { return len(server.Received("connect")) }, 100*time.Millisecond).Should(Equal(1))
+		})
+
+		It("should end subscriptions being stopped when the client closes", func() {
+			sub := client.Subscribe("builds", []interface{}{}, nil)
+			stopped := make(chan error, 1)
+			go func() { stopped <- sub.Stop() }()
+			Eventually(func() int { return len(server.Received("unsub")) }).Should(Equal(1))
+			client.Close()
+			Eventually(stopped).Should(Receive(BeNil()))
+			Ω(sub.Err()).Should(HaveOccurred())
+		})
+
+		It("should end subscriptions and calls after giving up", func() {
+			client.ReconnectPolicy = &ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 2}
+			sub := client.Subscribe("builds", []interface{}{}, nil)
+			call := client.Go("echo", []interface{}{}, nil)
+			server.Shutdown()
+			Eventually(sub.Ready()).Should(BeClosed())
+			Ω(sub.Err()).Should(HaveOccurred())
+			Ω(sub.Stop()).Should(Succeed())
+			Eventually(call.Done).Should(Receive())
+			Ω(call.Error).Should(HaveOccurred())
+		})
+
+		It("should stop waiting to reconnect when the client closes", func() {
+			client.ReconnectPolicy = &ExponentialBackoff{Initial: time.Hour}
+			server.Shutdown()
+			Eventually(func() ConnectionState { return client.Status().State }).Should(Equal(Waiting))
+			client.Close()
+			Eventually(func() string {
+				buf := make([]byte, 1<<20)
+				return string(buf[:runtime.Stack(buf, true)])
+			}).ShouldNot(ContainSubstring("reconnectLoop"))
+		})
+	})
+})
+
+var _ = Describe("Resync", func() {
+
+	var lock sync.Mutex
+	var published []map[string]interface{}
+	var release chan struct{}
+	var server *testServer
+	var client *Client
+
+	publish := func(docs ...map[string]interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		published = docs
+	}
+	doc := func(msg, id string, fields map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"msg": msg, "collection": "builds", "id": id, "fields": fields}
+	}
+
+	BeforeEach(func() {
+		release = make(chan struct{})
+		subs := 0
+		server = newTestServer(func(msg map[string]interface{}, send func(interface{})) {
+			switch msg["msg"] {
+			case "sub":
+				lock.Lock()
+				docs := published
+				subs++
+				resub := subs > 1
+				lock.Unlock()
+				for _, doc := range docs {
+					send(doc)
+				}
+				go func() {
+					// Hold back ready on the resent subscription
+					if resub {
+						<-release
+					}
+					send(map[string]interface{}{"msg": "ready", "subs": []string{msg["id"].(string)}})
+				}()
+			case "method":
+				go func() {
+					<-release
+					send(map[string]interface{}{"msg": "result", "id": msg["id"]})
+					send(map[string]interface{}{"msg": "updated", "methods": []string{msg["id"].(string)}})
+				}()
+			}
+		})
+		var err error
+		client, err = Dial(server.URL(), WithReconnectPolicy(NewExponentialBackoff(10*time.Millisecond, 10*time.Millisecond)))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should keep documents until resent data is complete and report only real changes", func() {
+		publish(
+			doc("added", "a", map[string]interface{}{"name": "a"}),
+			doc("added", "b", map[string]interface{}{"name": "b", "status": "running"}),
+			doc("added", "c", map[string]interface{}{"name": "c"}),
+		)
+		Ω(client.Sub("builds", nil)).Should(Succeed())
+		builds := client.CollectionByName("builds")
+		watcher := builds.(Watchable).Watch(0, DropOldest)
+		defer watcher.Stop()
+
+		publish(
+			doc("added", "b", map[string]interface{}{"name": "b", "owner": "ci"}),
+			doc("added", "c", map[string]interface{}{"name": "c"}),
+			doc("added", "d", map[string]interface{}{"name": "d"}),
+		)
+		server.Drop()
+		Eventually(func() int { return len(server.Received("sub")) }, 2*time.Second).Should(Equal(2))
+		Consistently(watcher.Events(), 100*time.Millisecond).ShouldNot(Receive())
+		Ω(builds.FindAll()).Should(HaveLen(3))
+		Ω(builds.FindOne("a")).ShouldNot(BeNil())
+
+		close(release)
+		events := []ChangeEvent{}
+		for i := 0; i < 3; i++ {
+			var event ChangeEvent
+			Eventually(watcher.Events()).Should(Receive(&event))
+			events = append(events, event)
+		}
+		Consistently(watcher.Events(), 100*time.Millisecond).ShouldNot(Receive())
+		Ω(events[0].Kind).Should(Equal(Removed))
+		Ω(events[0].ID).Should(Equal("a"))
+		Ω(events[1].Kind).Should(Equal(Changed))
+		Ω(events[1].ID).Should(Equal("b"))
+		Ω(events[1].Fields).Should(Equal(map[string]interface{}{"owner": "ci"}))
+		Ω(events[1].Cleared).Should(Equal([]string{"status"}))
+		Ω(events[2].Kind).Should(Equal(Added))
+		Ω(events[2].ID).Should(Equal("d"))
+		Ω(builds.FindOne("b")).Should(Equal(map[string]interface{}{"name": "b", "owner": "ci"}))
+	})
+
+	It("should restore the order of ordered collections", func() {
+		before := func(msg map[string]interface{}, id interface{}) map[string]interface{} {
+			msg["before"] = id
+			return msg
+		}
+		publish(
+			before(doc("addedBefore", "a", nil), nil),
+			before(doc("addedBefore", "b", nil), nil),
+			before(doc("addedBefore", "c", nil), nil),
+		)
+		Ω(client.Sub("builds", nil)).Should(Succeed())
+		builds := client.CollectionByName("builds").(*OrderedCache)
+		watcher := builds.Watch(0, DropOldest)
+		defer watcher.Stop()
+
+		publish(
+			before(doc("addedBefore", "c", nil), nil),
+			before(doc("addedBefore", "a", nil), nil),
+			before(doc("addedBefore", "d", nil), nil),
+			before(doc("addedBefore", "b", nil), nil),
+		)
+		server.Drop()
+		Eventually(func() int { return len(server.Received("sub")) }, 2*time.Second).Should(Equal(2))
+		close(release)
+		Eventually(builds.IDs).Should(Equal([]string{"c", "a", "d", "b"}))
+		var added, moved ChangeEvent
+		Eventually(watcher.Events()).Should(Receive(&added))
+		Eventually(watcher.Events()).Should(Receive(&moved))
+		Consistently(watcher.Events(), 100*time.Millisecond).ShouldNot(Receive())
+		Ω(added.Kind).Should(Equal(Added))
+		Ω(added.ID).Should(Equal("d"))
+		Ω(added.BeforeID).Should(Equal("b"))
+		Ω(moved.Kind).Should(Equal(Moved))
+		Ω(moved.ID).Should(Equal("c"))
+		Ω(moved.BeforeID).Should(Equal("a"))
+	})
+
+	It("should wait for the writes of resent methods", func() {
+		publish(doc("added", "a", map[string]interface{}{"name": "a"}))
+		Ω(client.Sub("builds", nil)).Should(Succeed())
+		call := client.Go("build", nil, nil)
+		Eventually(func() int { return len(server.Received("method")) }).Should(Equal(1))
+		publish(doc("added", "a", map[string]interface{}{"name": "built"}))
+		server.Drop()
+		Eventually(func() int { return len(server.Received("method")) }, 2*time.Second).Should(Equal(2))
+		Consistently(call.Updated(), 100*time.Millisecond).ShouldNot(BeClosed())
+		close(release)
+		Eventually(call.Updated()).Should(BeClosed())
+		Ω(client.CollectionByName("builds").FindOne("a")).Should(Equal(map[string]interface{}{"name": "built"}))
+	})
+})
@@ -0,0 +1,111 @@
+package ddp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+)
+
+// ----------------------------------------------------------------------
+// SockJS
+//
+// Meteor also serves DDP on /sockjs/<server>/<session>/websocket, which
+// wraps messages in SockJS frames:
+//
+//   o              - the session is open
+//   h              - heartbeat
+//   a["...", ...]  - an array of messages, each a JSON encoded string
+//   c[code,"..."]  - the server closed the session
+//
+// Only the websocket transport is supported - there is no long polling.
+// ----------------------------------------------------------------------
+
+// sockJSTransport speaks SockJS framing over another transport.
+type sockJSTransport struct {
+	Transport
+	// pending holds messages from the last array frame not yet read.
+	pending []string
+}
+
+// NewSockJSTransport wraps a transport connected to a SockJS websocket
+// endpoint, converting between SockJS frames and DDP messages. Like any
+// Transport it must only be read from one goroutine.
+func NewSockJSTransport(transport Transport) Transport {
+	return &sockJSTransport{Transport: transport}
+}
+
+// ReadMessage implements the Transport interface.
+func (t *sockJSTransport) ReadMessage() ([]byte, error) {
+	for len(t.pending) == 0 {
+		frame, err := t.Transport.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		switch frame[0] {
+		case 'o':
+			// The open frame carries no messages
+		case 'h':
+			// Report heartbeats so the client knows the server is alive
+			return []byte{}, nil
+		case 'a':
+			var messages []string
+			if err := json.Unmarshal(frame[1:], &messages); err != nil {
+				return nil, fmt.Errorf("sockjs: bad message frame: %v", err)
+			}
+			t.pending = messages
+		case 'c':
+			var reason []interface{}
+			json.Unmarshal(frame[1:], &reason)
+			return nil, fmt.Errorf("sockjs: server closed the session %v", reason)
+		default:
+			return nil, fmt.Errorf("sockjs: unknown frame %q", frame)
+		}
+	}
+	message := t.pending[0]
+	t.pending = t.pending[1:]
+	return []byte(message), nil
+}
+
+// WriteMessage implements the Transport interface.
+func (t *sockJSTransport) WriteMessage(data []byte) error {
+	frame, err := json.Marshal([]string{string(data)})
+	if err != nil {
+		return err
+	}
+	return t.Transport.WriteMessage(frame)
+}
+
+// isSockJSBase reports whether a server URL is the http(s) base address
+// of a Meteor app rather than a websocket endpoint.
+func isSockJSBase(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// sockJSURL returns a SockJS websocket endpoint with a random server and
+// session for the app at base.
+func sockJSURL(base *url.URL) *url.URL {
+	u := *base
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = fmt.Sprintf("%s/sockjs/%03d/%s/websocket", strings.TrimSuffix(u.Path, "/"), rand.Intn(1000), sockJSSession())
+	u.RawPath = ""
+	return &u
+}
+
+// sockJSSession returns a random SockJS session id.
+func sockJSSession() string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789_"
+	session := make([]byte, 8)
+	for i := range session {
+		session[i] = chars[rand.Intn(len(chars))]
+	}
+	return string(session)
+}
@@ -0,0 +1,147 @@
+package ddp_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"golang.org/x/net/websocket"
+)
+
+// sockJSServer is a minimal Meteor app serving DDP over SockJS framing.
+type sockJSServer struct {
+	*httptest.Server
+
+	// heartbeat is the interval between heartbeat frames, or zero for
+	// none after the first.
+	heartbeat time.Duration
+
+	lock  sync.Mutex
+	paths []string
+}
+
+func newSockJSServer() *sockJSServer {
+	s := &sockJSServer{}
+	s.Server = httptest.NewServer(websocket.Handler(s.serve))
+	return s
+}
+
+// Paths returns the request path of every connection.
+func (s *sockJSServer) Paths() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.paths...)
+}
+
+func (s *sockJSServer) serve(ws *websocket.Conn) {
+	s.lock.Lock()
+	s.paths = append(s.paths, ws.Request().URL.Path)
+	s.lock.Unlock()
+	send := func(msgs ...interface{}) {
+		frame := []string{}
+		for _, msg := range msgs {
+			data, _ := json.Marshal(msg)
+			frame = append(frame, string(data))
+		}
+		data, _ := json.Marshal(frame)
+		websocket.Message.Send(ws, "a"+string(data))
+	}
+	websocket.Message.Send(ws, "o")
+	for {
+		var frame string
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			return
+		}
+		var messages []string
+		json.Unmarshal([]byte(frame), &messages)
+		for _, message := range messages {
+			var msg map[string]interface{}
+			json.Unmarshal([]byte(message), &msg)
+			switch msg["msg"] {
+			case "connect":
+				websocket.Message.Send(ws, "h")
+				send(map[string]interface{}{"server_id": "0"}, map[string]interface{}{"msg": "connected", "session": "sockjs-session"})
+				if s.heartbeat > 0 {
+					go func() {
+						for websocket.Message.Send(ws, "h") == nil {
+							time.Sleep(s.heartbeat)
+						}
+					}()
+				}
+			case "method":
+				send(map[string]interface{}{"msg": "result", "id": msg["id"], "result": msg["params"]})
+			}
+		}
+	}
+}
+
+var _ = Describe("SockJS", func() {
+
+	It("should connect to an app from its http URL", func() {
+		server := newSockJSServer()
+		defer server.Close()
+		client, err := Dial(server.URL + "/app/")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(client.Session()).Should(Equal("sockjs-session"))
+		Ω(client.Call("echo", []interface{}{"hello"})).Should(Equal([]interface{}{"hello"}))
+		paths := server.Paths()
+		Ω(paths).Should(HaveLen(1))
+		Ω(paths[0]).Should(MatchRegexp(`^/app/sockjs/\d{3}/[a-z0-9_]{8}/websocket$`))
+	})
+
+	It("should connect to an explicit SockJS endpoint", func() {
+		server := newSockJSServer()
+		defer server.Close()
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/sockjs/123/abcdefgh/websocket"
+		client, err := Dial(url, WithSockJS())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Ω(server.Paths()).Should(Equal([]string{"/sockjs/123/abcdefgh/websocket"}))
+	})
+
+	It("should treat heartbeat frames as activity", func() {
+		// The server never answers pings
+		server := newSockJSServer()
+		server.heartbeat = 20 * time.Millisecond
+		defer server.Close()
+		client, err := Dial(server.URL, WithHeartbeat(100*time.Millisecond, 100*time.Millisecond))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		Consistently(func() int64 { return client.Stats().PingsSent }, 500*time.Millisecond).Should(BeZero())
+		Ω(server.Paths()).Should(HaveLen(1))
+	})
+
+	It("should unwrap message arrays", func() {
+		clientEnd, serverEnd := NewPipe()
+		defer clientEnd.Close()
+		transport := NewSockJSTransport(clientEnd)
+		go func() {
+			serverEnd.WriteMessage([]byte("o"))
+			serverEnd.WriteMessage([]byte("h"))
+			serverEnd.WriteMessage([]byte(`a["{\"msg\":\"ping\"}","{\"msg\":\"pong\"}"]`))
+			serverEnd.WriteMessage([]byte(`c[3000,"Go away!"]`))
+		}()
+		// Heartbeats are read as empty messages
+		Ω(transport.ReadMessage()).Should(BeEmpty())
+		Ω(transport.ReadMessage()).Should(Equal([]byte(`{"msg":"ping"}`)))
+		Ω(transport.ReadMessage()).Should(Equal([]byte(`{"msg":"pong"}`)))
+		_, err := transport.ReadMessage()
+		Ω(err).Should(MatchError(ContainSubstring("Go away!")))
+	})
+
+	It("should wrap written messages", func() {
+		clientEnd, serverEnd := NewPipe()
+		defer clientEnd.Close()
+		transport := NewSockJSTransport(clientEnd)
+		go transport.WriteMessage([]byte(`{"msg":"ping"}`))
+		Ω(serverEnd.ReadMessage()).Should(Equal([]byte(`["{\"msg\":\"ping\"}"]`)))
+	})
+})
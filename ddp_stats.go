@@ -0,0 +1,138 @@
+package ddp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------
+// Statistics
+//
+// The client gathers i/o statistics by wrapping the transport, so
+// each operation is a whole DDP message. Each connection gets a
+// fresh set of counters that also feed the client's lifetime totals.
+// ---------------------------------------------------------------
+
+// Stats tracks statistics for i/o operations.
+type Stats struct {
+	// Bytes is the total number of bytes transferred.
+	Bytes int64
+	// Ops is the total number of i/o operations performed.
+	Ops int64
+	// Errors is the total number of i/o errors encountered.
+	Errors int64
+	// Runtime is the duration that stats have been gathered.
+	Runtime time.Duration
+}
+
+// ClientStats displays combined statistics for the Client.
+type ClientStats struct {
+	// Reads provides statistics on the messages read on the current connection.
+	Reads *Stats
+	// TotalReads provides statistics on the messages read on all client connections.
+	TotalReads *Stats
+	// Writes provides statistics on the messages written on the current connection.
+	Writes *Stats
+	// TotalWrites provides statistics on the messages written on all client connections.
+	TotalWrites *Stats
+	// Reconnects is the number of reconnections the client has made.
+	Reconnects int64
+	// PingsSent is the number of pings sent by the client.
+	PingsSent int64
+	// PingsRecv is the number of pings received from the server.
+	PingsRecv int64
+}
+
+// statsTracker accumulates i/o statistics and is safe for concurrent use.
+type statsTracker struct {
+	bytes  int64
+	ops    int64
+	errors int64
+	start  time.Time
+	lock   sync.Mutex
+}
+
+// newStatsTracker creates a tracker that starts gathering stats immediately.
+func newStatsTracker() *statsTracker {
+	return &statsTracker{start: time.Now()}
+}
+
+// op records the outcome of a single i/o operation. An io.EOF is the
+// normal end of a stream and is not counted as an error.
+func (t *statsTracker) op(n int, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ops++
+	t.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		t.errors++
+	}
+}
+
+// snapshot returns a copy of the current statistics.
+func (t *statsTracker) snapshot() *Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return &Stats{
+		Bytes:   t.bytes,
+		Ops:     t.ops,
+		Errors:  t.errors,
+		Runtime: time.Since(t.start),
+	}
+}
+
+// reset clears all counters and restarts the runtime clock.
+func (t *statsTracker) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.bytes = 0
+	t.ops = 0
+	t.errors = 0
+	t.start = time.Now()
+}
+
+// transportStats tracks statistics on any Transport, recording each
+// message with all of the read and write trackers. Operations cut short
+// because the client closed the transport itself aren't recorded.
+type transportStats struct {
+	Transport
+	reads  []*statsTracker
+	writes []*statsTracker
+	// closed reports whether the client closed the transport.
+	closed func() bool
+}
+
+// deliberate returns true if err comes from the client closing the
+// transport.
+func (t *transportStats) deliberate(err error) bool {
+	return err != nil && t.closed != nil && t.closed()
+}
+
+// ReadMessage implements the Transport interface.
+func (t *transportStats) ReadMessage() ([]byte, error) {
+	data, err := t.Transport.ReadMessage()
+	if t.deliberate(err) {
+		return data, err
+	}
+	for _, tracker := range t.reads {
+		tracker.op(len(data), err)
+	}
+	return data, err
+}
+
+// WriteMessage implements the Transport interface.
+func (t *transportStats) WriteMessage(data []byte) error {
+	err := t.Transport.WriteMessage(data)
+	if t.deliberate(err) {
+		return err
+	}
+	n := len(data)
+	if err != nil {
+		n = 0
+	}
+	for _, tracker := range t.writes {
+		tracker.op(n, err)
+	}
+	return err
+}
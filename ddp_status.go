@@ -0,0 +1,159 @@
+package ddp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ConnectionState is the state of the client's connection to the server.
+// The states mirror those reported by Meteor.status().
+type ConnectionState int
+
+const (
+	// Connecting means the client is dialing the server or waiting for the
+	// DDP handshake to complete.
+	Connecting ConnectionState = iota
+	// Connected means the DDP session is established.
+	Connected
+	// Waiting means the connection was lost and the client is waiting to
+	// retry.
+	Waiting
+	// Failed means the client has given up connecting to the server.
+	Failed
+	// Offline means the client was closed.
+	Offline
+)
+
+// String returns the Meteor name for the state.
+func (s ConnectionState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Waiting:
+		return "waiting"
+	case Failed:
+		return "failed"
+	case Offline:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+// Status describes the client's connection to the server.
+type Status struct {
+	// State is the current connection state.
+	State ConnectionState
+	// RetryCount is the number of reconnect attempts made since the client
+	// was last connected.
+	RetryCount int
+	// NextRetry is when the next reconnect attempt is due while Waiting.
+	NextRetry time.Time
+	// LastError is the error that caused the most recent disconnection or
+	// failed reconnect attempt. It is cleared once connected.
+	LastError error
+}
+
+// equal reports whether two statuses are the same. Errors are compared by
+// message since not every error value is comparable.
+func (s Status) equal(other Status) bool {
+	if s.State != other.State || s.RetryCount != other.RetryCount || !s.NextRetry.Equal(other.NextRetry) {
+		return false
+	}
+	if s.LastError == nil || other.LastError == nil {
+		return s.LastError == other.LastError
+	}
+	return s.LastError.Error() == other.LastError.Error()
+}
+
+// Status returns the current connection status.
+func (c *Client) Status() Status {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.status
+}
+
+// OnStatusChange registers a function that is called with the new status
+// every time the connection status changes. Handlers are called in order,
+// one change at a time, and may call back into the client.
+func (c *Client) OnStatusChange(handler func(Status)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statusHandlers = append(c.statusHandlers, handler)
+}
+
+// updateStatus applies update to the connection status and notifies the
+// status handlers if anything changed.
+func (c *Client) updateStatus(update func(status *Status)) {
+	c.lock.Lock()
+	status := c.status
+	update(&status)
+	if status.equal(c.status) {
+		c.lock.Unlock()
+		return
+	}
+	c.status = status
+	close(c.statusSignal)
+	c.statusSignal = make(chan struct{})
+	c.statusQueue = append(c.statusQueue, status)
+	if c.notifying {
+		// The goroutine already notifying will deliver this change
+		c.lock.Unlock()
+		return
+	}
+	c.notifying = true
+	for len(c.statusQueue) > 0 {
+		next := c.statusQueue[0]
+		c.statusQueue = c.statusQueue[1:]
+		handlers := c.statusHandlers
+		c.lock.Unlock()
+		for _, handler := range handlers {
+			handler(next)
+		}
+		c.lock.Lock()
+	}
+	c.notifying = false
+	c.lock.Unlock()
+}
+
+// waitForHandshake waits for the DDP handshake to complete, returning an
+// error if the connection drops, the server refuses the connection or the
+// context is done first.
+func (c *Client) waitForHandshake(ctx context.Context) error {
+	for {
+		c.lock.Lock()
+		status, signal := c.status, c.statusSignal
+		c.lock.Unlock()
+		switch status.State {
+		case Connected:
+			return nil
+		case Waiting, Failed, Offline:
+			if status.LastError != nil {
+				return status.LastError
+			}
+			return fmt.Errorf("connection %s during DDP handshake", status.State)
+		}
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for connected: %w", ctx.Err())
+		}
+	}
+}
+
+// setState moves to a new state, recording err as the last error if it is
+// not nil.
+func (c *Client) setState(state ConnectionState, err error) {
+	c.updateStatus(func(status *Status) {
+		status.State = state
+		if state != Waiting {
+			status.NextRetry = time.Time{}
+		}
+		if err != nil {
+			status.LastError = err
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package ddp_test
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Status", func() {
+
+	var server *testServer
+	var client *Client
+	var lock sync.Mutex
+	var states []ConnectionState
+
+	// seen returns the state transitions - a status change that only
+	// updates the retry details doesn't change the state.
+	seen := func() []ConnectionState {
+		lock.Lock()
+		defer lock.Unlock()
+		transitions := []ConnectionState{}
+		for _, state := range states {
+			if len(transitions) == 0 || transitions[len(transitions)-1] != state {
+				transitions = append(transitions, state)
+			}
+		}
+		return transitions
+	}
+
+	BeforeEach(func() {
+		server = newTestServer(nil)
+		var err error
+		client, err = NewClient(server.URL(), "http://localhost/")
+		Ω(err).ShouldNot(HaveOccurred())
+		client.ReconnectPolicy = &ExponentialBackoff{Initial: 20 * time.Millisecond, Multiplier: 2, MaxAttempts: 2}
+		Eventually(func() ConnectionState { return client.Status().State }).Should(Equal(Connected))
+		lock.Lock()
+		states = nil
+		lock.Unlock()
+		client.OnStatusChange(func(status Status) {
+			lock.Lock()
+			states = append(states, status.State)
+			lock.Unlock()
+		})
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should name states like Meteor", func() {
+		Ω(Connecting.String()).Should(Equal("connecting"))
+		Ω(Connected.String()).Should(Equal("connected"))
+		Ω(Waiting.String()).Should(Equal("waiting"))
+		Ω(Failed.String()).Should(Equal("failed"))
+		Ω(Offline.String()).Should(Equal("offline"))
+	})
+
+	It("should report a connected client", func() {
+		status := client.Status()
+		Ω(status.RetryCount).Should(BeZero())
+		Ω(status.LastError).ShouldNot(HaveOccurred())
+		Ω(status.NextRetry.IsZero()).Should(BeTrue())
+	})
+
+	It("should go through waiting and connecting when reconnecting", func() {
+		server.Drop()
+		Eventually(seen).Should(Equal([]ConnectionState{Waiting, Connecting, Connected}))
+		Ω(client.Status().RetryCount).Should(BeZero())
+	})
+
+	It("should report retries and give up", func() {
+		server.Shutdown()
+		Eventually(func() ConnectionState { return client.Status().State }).Should(Equal(Waiting))
+		status := client.Status()
+		Ω(status.NextRetry.IsZero()).Should(BeFalse())
+
+		Eventually(func() ConnectionState { return client.Status().State }).Should(Equal(Failed))
+		status = client.Status()
+		Ω(status.RetryCount).Should(Equal(2))
+		Ω(status.LastError).Should(HaveOccurred())
+		Ω(seen()).Should(Equal([]ConnectionState{Waiting, Connecting, Waiting, Connecting, Waiting, Failed}))
+	})
+
+	It("should go offline when closed", func() {
+		client.Close()
+		Ω(client.Status().State).Should(Equal(Offline))
+		Ω(seen()).Should(Equal([]ConnectionState{Offline}))
+	})
+
+	It("should let handlers call back into the client", func() {
+		statuses := make(chan Status, 10)
+		client.OnStatusChange(func(status Status) {
+			statuses <- client.Status()
+		})
+		client.Close()
+		Eventually(statuses).Should(Receive(Equal(client.Status())))
+	})
+})
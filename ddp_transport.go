@@ -0,0 +1,152 @@
+package ddp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	gorilla "github.com/gorilla/websocket"
+	"golang.org/x/net/websocket"
+)
+
+// ----------------------------------------------------------------------
+// Transports
+//
+// The client exchanges whole DDP messages with the server over a
+// Transport. Adapters are provided for golang.org/x/net/websocket (the
+// default), github.com/gorilla/websocket and an in-memory pipe for tests.
+// ----------------------------------------------------------------------
+
+// Transport carries DDP messages between the client and the server. The
+// client reads from one goroutine and writes from another, and may call
+// Close from any goroutine.
+type Transport interface {
+	// ReadMessage blocks until the next message arrives. An empty message
+	// carries no DDP message but shows the connection is alive, as SockJS
+	// heartbeats do.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends a single message.
+	WriteMessage(data []byte) error
+	// Close closes the transport, unblocking any pending reads.
+	Close() error
+}
+
+// TransportDialer opens a transport to the server at url. Set one with
+// WithTransport to replace the default websocket.
+type TransportDialer func(ctx context.Context, url string) (Transport, error)
+
+// websocketTransport adapts a golang.org/x/net/websocket connection.
+type websocketTransport struct {
+	ws *websocket.Conn
+}
+
+// NewWebsocketTransport creates a transport on a golang.org/x/net/websocket
+// connection.
+func NewWebsocketTransport(ws *websocket.Conn) Transport {
+	return &websocketTransport{ws: ws}
+}
+
+// ReadMessage implements the Transport interface.
+func (t *websocketTransport) ReadMessage() ([]byte, error) {
+	var data []byte
+	err := websocket.Message.Receive(t.ws, &data)
+	return data, err
+}
+
+// WriteMessage implements the Transport interface.
+func (t *websocketTransport) WriteMessage(data []byte) error {
+	return websocket.Message.Send(t.ws, string(data))
+}
+
+// Close implements the Transport interface.
+func (t *websocketTransport) Close() error {
+	return t.ws.Close()
+}
+
+// gorillaTransport adapts a github.com/gorilla/websocket connection.
+type gorillaTransport struct {
+	conn *gorilla.Conn
+}
+
+// NewGorillaTransport creates a transport on a github.com/gorilla/websocket
+// connection.
+func NewGorillaTransport(conn *gorilla.Conn) Transport {
+	return &gorillaTransport{conn: conn}
+}
+
+// ReadMessage implements the Transport interface.
+func (t *gorillaTransport) ReadMessage() ([]byte, error) {
+	_, data, err := t.conn.ReadMessage()
+	return data, err
+}
+
+// WriteMessage implements the Transport interface.
+func (t *gorillaTransport) WriteMessage(data []byte) error {
+	return t.conn.WriteMessage(gorilla.TextMessage, data)
+}
+
+// Close implements the Transport interface.
+func (t *gorillaTransport) Close() error {
+	return t.conn.Close()
+}
+
+// GorillaDialer returns a TransportDialer that connects with the
+// github.com/gorilla/websocket dialer, sending header with the handshake.
+// A nil dialer uses gorilla's DefaultDialer.
+func GorillaDialer(dialer *gorilla.Dialer, header http.Header) TransportDialer {
+	if dialer == nil {
+		dialer = gorilla.DefaultDialer
+	}
+	return func(ctx context.Context, url string) (Transport, error) {
+		conn, _, err := dialer.DialContext(ctx, url, header)
+		if err != nil {
+			return nil, err
+		}
+		return NewGorillaTransport(conn), nil
+	}
+}
+
+// pipeTransport is one end of an in-memory pipe.
+type pipeTransport struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+}
+
+// NewPipe creates a connected pair of in-memory transports. Each write
+// blocks until the other end reads it. Closing either end closes both.
+func NewPipe() (Transport, Transport) {
+	a, b := make(chan []byte), make(chan []byte)
+	closed := make(chan struct{})
+	once := &sync.Once{}
+	return &pipeTransport{in: a, out: b, closed: closed, once: once},
+		&pipeTransport{in: b, out: a, closed: closed, once: once}
+}
+
+// ReadMessage implements the Transport interface.
+func (t *pipeTransport) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-t.in:
+		return data, nil
+	case <-t.closed:
+		return nil, io.EOF
+	}
+}
+
+// WriteMessage implements the Transport interface.
+func (t *pipeTransport) WriteMessage(data []byte) error {
+	select {
+	case t.out <- append([]byte(nil), data...):
+		return nil
+	case <-t.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// Close implements the Transport interface.
+func (t *pipeTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
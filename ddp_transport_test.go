@@ -0,0 +1,93 @@
+package ddp_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// servePipe answers the DDP handshake and echoes method calls on the
+// server end of a pipe until it is closed.
+func servePipe(transport Transport) {
+	send := func(msg interface{}) {
+		data, _ := json.Marshal(msg)
+		transport.WriteMessage(data)
+	}
+	for {
+		data, err := transport.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(data, &msg)
+		switch msg["msg"] {
+		case "connect":
+			send(map[string]interface{}{"msg": "connected", "session": "pipe-session"})
+		case "method":
+			send(map[string]interface{}{"msg": "result", "id": msg["id"], "result": msg["params"]})
+		}
+	}
+}
+
+var _ = Describe("Transport", func() {
+
+	Describe("Pipe", func() {
+
+		It("should deliver messages in both directions", func() {
+			a, b := NewPipe()
+			go a.WriteMessage([]byte("ping"))
+			Ω(b.ReadMessage()).Should(Equal([]byte("ping")))
+			go b.WriteMessage([]byte("pong"))
+			Ω(a.ReadMessage()).Should(Equal([]byte("pong")))
+		})
+
+		It("should close both ends", func() {
+			a, b := NewPipe()
+			Ω(a.Close()).Should(Succeed())
+			_, err := b.ReadMessage()
+			Ω(err).Should(Equal(io.EOF))
+			Ω(b.WriteMessage([]byte("late"))).Should(Equal(io.ErrClosedPipe))
+		})
+
+		It("should run a client without sockets", func() {
+			clientEnd, serverEnd := NewPipe()
+			go servePipe(serverEnd)
+			defer serverEnd.Close()
+			client, err := Dial("pipe://test", WithTransport(func(ctx context.Context, url string) (Transport, error) {
+				Ω(url).Should(Equal("pipe://test"))
+				return clientEnd, nil
+			}))
+			Ω(err).ShouldNot(HaveOccurred())
+			defer client.Close()
+			Ω(client.Session()).Should(Equal("pipe-session"))
+			Ω(client.Call("echo", []interface{}{"hello"})).Should(Equal([]interface{}{"hello"}))
+
+			stats := client.Stats()
+			Ω(stats.Writes.Ops).Should(Equal(int64(2)))
+			Ω(stats.Reads.Ops).Should(Equal(int64(2)))
+		})
+	})
+
+	Describe("Gorilla", func() {
+
+		It("should connect to a server", func() {
+			server := newTestServer(func(msg map[string]interface{}, send func(interface{})) {
+				send(map[string]interface{}{"msg": "result", "id": msg["id"], "result": msg["params"]})
+			})
+			defer server.Close()
+			// The x/net websocket server requires an origin
+			header := http.Header{"Origin": {"http://localhost/"}}
+			client, err := Dial(server.URL(), WithTransport(GorillaDialer(nil, header)))
+			Ω(err).ShouldNot(HaveOccurred())
+			defer client.Close()
+			Ω(client.Session()).Should(Equal("test-session"))
+			Ω(client.Call("echo", []interface{}{"hello"})).Should(Equal([]interface{}{"hello"}))
+		})
+	})
+})
@@ -0,0 +1,180 @@
+package ddp
+
+import (
+	"sync"
+)
+
+// ----------------------------------------------------------------------
+// Typed collections
+//
+// A TypedCollection decodes cached documents into a Go type the way
+// encoding/json would, after converting EJSON values - so dates decode
+// into time.Time and binary into []byte. Documents are decoded with their
+// "_id", so a field tagged `json:"_id"` receives the document id.
+// ----------------------------------------------------------------------
+
+// TypedCollection decodes the documents of a collection into T.
+type TypedCollection[T any] struct {
+	collection Collection
+}
+
+// NewTypedCollection wraps a collection, usually one from
+// Client.CollectionByName, to decode its documents into T.
+func NewTypedCollection[T any](collection Collection) *TypedCollection[T] {
+	return &TypedCollection[T]{collection: collection}
+}
+
+// Collection returns the underlying collection.
+func (c *TypedCollection[T]) Collection() Collection {
+	return c.collection
+}
+
+// Get returns the document with matching id. It returns false if there is
+// no such document or it can't be decoded, which is logged.
+func (c *TypedCollection[T]) Get(id string) (T, bool) {
+	var value T
+	fields, ok := c.collection.FindOne(id).(map[string]interface{})
+	if !ok {
+		return value, false
+	}
+	value, err := decodeDocument[T](id, fields)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Warn("Could not decode document")
+		return value, false
+	}
+	return value, true
+}
+
+// All returns every document, ordered by id or in the order of an
+// OrderedCache. Documents that can't be decoded are logged and left out.
+func (c *TypedCollection[T]) All() []T {
+	cursor := NewCursor(c.collection, nil, nil)
+	values := make([]T, 0, cursor.Count())
+	for cursor.Next() {
+		var value T
+		if err := cursor.Decode(&value); err != nil {
+			log.WithError(err).WithField("id", cursor.Doc()["_id"]).Warn("Could not decode document")
+			continue
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// Find returns the documents matching a query, decoded. opts may be nil.
+func (c *TypedCollection[T]) Find(selector Selector, opts *FindOptions) ([]T, error) {
+	cursor := NewCursor(c.collection, selector, opts)
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	values := make([]T, 0, cursor.Count())
+	for cursor.Next() {
+		var value T
+		if err := cursor.Decode(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Watch returns a watcher for typed change events. size and policy apply
+// as for KeyCache.Watch. If the collection isn't Watchable the watcher is
+// stopped with ErrNotWatchable.
+func (c *TypedCollection[T]) Watch(size int, policy OverflowPolicy) *TypedWatcher[T] {
+	w := &TypedWatcher[T]{
+		watcher: watch(c.collection, size, policy),
+		events:  make(chan TypedChangeEvent[T]),
+		done:    make(chan struct{}),
+	}
+	go w.forward()
+	return w
+}
+
+// decodeDocument decodes a document's fields, with its id, into T.
+func decodeDocument[T any](id string, fields map[string]interface{}) (T, error) {
+	var value T
+	err := decodeEJSON(documentWithID(id, fields), &value)
+	return value, err
+}
+
+// TypedChangeEvent describes a change to a typed collection.
+type TypedChangeEvent[T any] struct {
+	// Kind is the kind of change.
+	Kind ChangeKind
+	// ID is the id of the document. It is empty for Reset.
+	ID string
+	// BeforeID is the id of the document an added or moved document now
+	// precedes in an ordered collection.
+	BeforeID string
+	// Cleared lists the fields removed by a Changed event.
+	Cleared []string
+	// Before is the document before the change, nil for Added and Reset.
+	Before *T
+	// After is the document after the change, nil for Removed and Reset.
+	After *T
+	// Err reports a document that couldn't be decoded.
+	Err error
+}
+
+// TypedWatcher delivers typed change events from a collection.
+type TypedWatcher[T any] struct {
+	watcher *Watcher
+	events  chan TypedChangeEvent[T]
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Events returns the channel the events are delivered on. It is closed
+// once the watcher stops.
+func (w *TypedWatcher[T]) Events() <-chan TypedChangeEvent[T] {
+	return w.events
+}
+
+// Dropped returns the number of events discarded because the buffer was
+// full.
+func (w *TypedWatcher[T]) Dropped() int64 {
+	return w.watcher.Dropped()
+}
+
+// Err returns ErrWatcherOverflow if the watcher was disconnected because
+// it fell behind, or nil.
+func (w *TypedWatcher[T]) Err() error {
+	return w.watcher.Err()
+}
+
+// Stop unregisters the watcher and closes the events channel.
+func (w *TypedWatcher[T]) Stop() {
+	w.once.Do(func() { close(w.done) })
+	w.watcher.Stop()
+}
+
+// forward decodes events from the watcher until it stops.
+func (w *TypedWatcher[T]) forward() {
+	defer close(w.events)
+	for event := range w.watcher.Events() {
+		typed := TypedChangeEvent[T]{Kind: event.Kind, ID: event.ID, BeforeID: event.BeforeID, Cleared: event.Cleared}
+		typed.Before, typed.Err = decodeEventDocument[T](event.ID, event.Before)
+		if typed.Err == nil {
+			typed.After, typed.Err = decodeEventDocument[T](event.ID, event.After)
+		}
+		select {
+		case w.events <- typed:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// decodeEventDocument decodes a document from a change event, returning
+// nil if there isn't one.
+func decodeEventDocument[T any](id string, fields map[string]interface{}) (*T, error) {
+	if fields == nil {
+		return nil, nil
+	}
+	value, err := decodeDocument[T](id, fields)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
@@ -0,0 +1,119 @@
+package ddp_test
+
+import (
+	"time"
+
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type build struct {
+	ID       string    `json:"_id"`
+	Name     string    `json:"name"`
+	Duration int       `json:"duration"`
+	Started  time.Time `json:"started"`
+	Log      []byte    `json:"log"`
+	Repo     struct {
+		Owner string `json:"owner"`
+	} `json:"repo"`
+}
+
+var _ = Describe("TypedCollection", func() {
+
+	var collection Collection
+	var builds *TypedCollection[build]
+
+	add := func(id string, fields map[string]interface{}) {
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": id, "fields": fields})
+	}
+
+	BeforeEach(func() {
+		collection = NewCollection("builds")
+		builds = NewTypedCollection[build](collection)
+		add("a", map[string]interface{}{
+			"name":     "nightly",
+			"duration": 120.0,
+			"started":  map[string]interface{}{"$date": 1500000000000.0},
+			"log":      map[string]interface{}{"$binary": "aGVsbG8="},
+			"repo":     map[string]interface{}{"owner": "gopackage"},
+		})
+		add("b", map[string]interface{}{"name": "release", "duration": 300.0})
+	})
+
+	It("should decode documents", func() {
+		a, ok := builds.Get("a")
+		Ω(ok).Should(BeTrue())
+		Ω(a.ID).Should(Equal("a"))
+		Ω(a.Name).Should(Equal("nightly"))
+		Ω(a.Duration).Should(Equal(120))
+		Ω(a.Started.Equal(time.Unix(1500000000, 0))).Should(BeTrue())
+		Ω(a.Log).Should(Equal([]byte("hello")))
+		Ω(a.Repo.Owner).Should(Equal("gopackage"))
+		_, ok = builds.Get("missing")
+		Ω(ok).Should(BeFalse())
+		Ω(builds.Collection()).Should(BeIdenticalTo(collection))
+	})
+
+	It("should skip documents that can't be decoded", func() {
+		add("c", map[string]interface{}{"name": 5.0})
+		_, ok := builds.Get("c")
+		Ω(ok).Should(BeFalse())
+		all := builds.All()
+		Ω(all).Should(HaveLen(2))
+		Ω(all[0].ID).Should(Equal("a"))
+		Ω(all[1].ID).Should(Equal("b"))
+		_, err := builds.Find(nil, nil)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("should run typed queries", func() {
+		found, err := builds.Find(Selector{"duration": Selector{"$gt": 100}}, &FindOptions{Sort: []SortField{{Field: "duration", Descending: true}}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(found).Should(HaveLen(2))
+		Ω(found[0].Name).Should(Equal("release"))
+		Ω(found[1].Name).Should(Equal("nightly"))
+		_, err = builds.Find(Selector{"$bad": true}, nil)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("should send typed change events", func() {
+		watcher := builds.Watch(0, DropOldest)
+		defer watcher.Stop()
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "b", "fields": map[string]interface{}{"duration": 310.0}, "cleared": []interface{}{"name"}})
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "a"})
+		collection.Reset()
+
+		var event TypedChangeEvent[build]
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Changed))
+		Ω(event.Err).ShouldNot(HaveOccurred())
+		Ω(event.Before.Duration).Should(Equal(300))
+		Ω(event.After.Duration).Should(Equal(310))
+		Ω(event.After.Name).Should(BeEmpty())
+		Ω(event.Cleared).Should(Equal([]string{"name"}))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Removed))
+		Ω(event.Before.Name).Should(Equal("nightly"))
+		Ω(event.After).Should(BeNil())
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Reset))
+		Ω(event.Before).Should(BeNil())
+	})
+
+	It("should report decode errors in events and stop", func() {
+		watcher := builds.Watch(0, DropOldest)
+		add("c", map[string]interface{}{"name": 5.0})
+		var event TypedChangeEvent[build]
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Added))
+		Ω(event.ID).Should(Equal("c"))
+		Ω(event.Err).Should(HaveOccurred())
+		Ω(event.After).Should(BeNil())
+		// Stopping doesn't need the pending event to be received
+		add("d", nil)
+		watcher.Stop()
+		Eventually(watcher.Events()).Should(BeClosed())
+	})
+})
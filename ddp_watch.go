@@ -0,0 +1,313 @@
+package ddp
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ----------------------------------------------------------------------
+// Watchers
+//
+// Collections are updated from the client's single inbox goroutine, so
+// change events are queued per watcher and delivered from the watcher's
+// own goroutine. A slow consumer only ever holds up itself.
+// ----------------------------------------------------------------------
+
+// OverflowPolicy decides what a watcher does when its buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued event to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the event that doesn't fit.
+	DropNewest
+	// CoalesceByID merges queued events for the same document so at most
+	// one event per document is pending, keeping the position of ordered
+	// additions. If the buffer is still full the oldest event is dropped.
+	CoalesceByID
+	// Disconnect stops the watcher, closing its channel.
+	Disconnect
+)
+
+// ErrWatcherOverflow is reported by a watcher disconnected because its
+// buffer overflowed.
+var ErrWatcherOverflow = errors.New("ddp: watcher buffer overflowed")
+
+// ErrNotWatchable is reported by watchers on collections that don't
+// implement Watchable.
+var ErrNotWatchable = errors.New("ddp: collection can't be watched")
+
+// Watchable is implemented by collections that deliver change events to
+// watchers, as the built in collections do.
+type Watchable interface {
+	// Watch returns a watcher that buffers up to size change events,
+	// applying policy when the buffer is full.
+	Watch(size int, policy OverflowPolicy) *Watcher
+}
+
+// watch starts a watcher on collection, or returns one already stopped
+// with ErrNotWatchable if the collection can't be watched.
+func watch(collection Collection, size int, policy OverflowPolicy) *Watcher {
+	if source, ok := collection.(Watchable); ok {
+		return source.Watch(size, policy)
+	}
+	watcher := newWatcher(size, policy)
+	watcher.stop(ErrNotWatchable)
+	return watcher
+}
+
+// Watcher delivers change events from a collection.
+type Watcher struct {
+	events chan ChangeEvent
+	size   int
+	policy OverflowPolicy
+	// ordered is set for watchers on ordered collections, where events
+	// carry positions.
+	ordered bool
+	// detach removes the watcher from its collection.
+	detach func()
+
+	// lock protects the fields below.
+	lock    sync.Mutex
+	ready   *sync.Cond
+	queue   []ChangeEvent
+	dropped int64
+	err     error
+	stopped bool
+	done    chan struct{}
+}
+
+// newWatcher creates a watcher and starts delivering its events. A size of
+// zero or less means the buffer is unbounded.
+func newWatcher(size int, policy OverflowPolicy) *Watcher {
+	w := &Watcher{
+		events: make(chan ChangeEvent),
+		size:   size,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	w.ready = sync.NewCond(&w.lock)
+	go w.deliver()
+	return w
+}
+
+// Events returns the channel the events are delivered on. It is closed
+// once the watcher stops.
+func (w *Watcher) Events() <-chan ChangeEvent {
+	return w.events
+}
+
+// Pending returns the number of events queued for delivery, not counting
+// an event the watcher is waiting to hand over.
+func (w *Watcher) Pending() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.queue)
+}
+
+// Dropped returns the number of events discarded because the buffer was
+// full.
+func (w *Watcher) Dropped() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.dropped
+}
+
+// Err returns ErrWatcherOverflow if the watcher was disconnected because
+// it fell behind, or nil.
+func (w *Watcher) Err() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+// Stop unregisters the watcher from its collection and closes the events
+// channel. Queued events are discarded.
+func (w *Watcher) Stop() {
+	w.stop(nil)
+}
+
+// stop shuts down the watcher, recording err as the reason.
+func (w *Watcher) stop(err error) {
+	w.lock.Lock()
+	if w.stopped {
+		w.lock.Unlock()
+		return
+	}
+	w.stopped = true
+	w.err = err
+	w.queue = nil
+	close(w.done)
+	w.ready.Broadcast()
+	detach := w.detach
+	w.lock.Unlock()
+	if detach != nil {
+		detach()
+	}
+}
+
+// push queues an event without blocking, applying the overflow policy if
+// the buffer is full.
+func (w *Watcher) push(event ChangeEvent) {
+	w.lock.Lock()
+	if w.stopped {
+		w.lock.Unlock()
+		return
+	}
+	if w.policy == CoalesceByID && w.coalesce(event) {
+		w.lock.Unlock()
+		return
+	}
+	if w.size > 0 && len(w.queue) >= w.size {
+		switch w.policy {
+		case DropNewest:
+			w.dropped++
+			w.lock.Unlock()
+			return
+		case Disconnect:
+			w.lock.Unlock()
+			w.stop(ErrWatcherOverflow)
+			return
+		default:
+			w.queue = w.queue[1:]
+			w.dropped++
+		}
+	}
+	w.queue = append(w.queue, event)
+	w.ready.Signal()
+	w.lock.Unlock()
+}
+
+// coalesce merges event into the queue, returning true if it was absorbed
+// by a queued event for the same document. A Reset supersedes everything
+// queued before it.
+func (w *Watcher) coalesce(event ChangeEvent) bool {
+	if event.Kind == Reset {
+		w.queue = w.queue[:0]
+		return false
+	}
+	// Merge with the latest event for the document
+	for i := len(w.queue) - 1; i >= 0; i-- {
+		queued := w.queue[i]
+		if queued.Kind == Reset {
+			return false
+		}
+		if queued.ID != event.ID {
+			continue
+		}
+		if w.ordered && queued.Kind == Removed {
+			return false
+		}
+		merged, keep, ok := mergeEvents(queued, event)
+		if !ok {
+			return false
+		}
+		if keep {
+			w.queue[i] = merged
+		} else {
+			w.queue = append(w.queue[:i], w.queue[i+1:]...)
+		}
+		return true
+	}
+	return false
+}
+
+// deliver sends queued events to the events channel until the watcher
+// stops.
+func (w *Watcher) deliver() {
+	defer close(w.events)
+	for {
+		w.lock.Lock()
+		for len(w.queue) == 0 && !w.stopped {
+			w.ready.Wait()
+		}
+		if w.stopped {
+			w.lock.Unlock()
+			return
+		}
+		event := w.queue[0]
+		w.queue = w.queue[1:]
+		w.lock.Unlock()
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// mergeEvents combines two consecutive events for the same document into
+// one. keep is false if the events cancel out, and ok is false if they
+// can't be combined.
+func mergeEvents(first, second ChangeEvent) (merged ChangeEvent, keep bool, ok bool) {
+	merged = ChangeEvent{
+		Collection: first.Collection,
+		ID:         first.ID,
+		Before:     first.Before,
+		After:      second.After,
+	}
+	switch {
+	case first.Kind == Added && second.Kind == Changed:
+		merged.Kind = Added
+		merged.Fields = second.After
+		merged.BeforeID = first.BeforeID
+	case first.Kind == Changed && second.Kind == Changed:
+		merged.Kind = Changed
+		merged.Fields = map[string]interface{}{}
+		for _, fields := range []map[string]interface{}{first.Fields, second.Fields} {
+			for key := range fields {
+				if value, ok := second.After[key]; ok {
+					merged.Fields[key] = value
+				}
+			}
+		}
+		for _, cleared := range [][]string{first.Cleared, second.Cleared} {
+			for _, key := range cleared {
+				if _, ok := second.After[key]; !ok {
+					merged.Cleared = appendUnique(merged.Cleared, key)
+				}
+			}
+		}
+	case first.Kind == Removed && second.Kind == Added:
+		merged.Kind = Changed
+		merged.Fields, merged.Cleared = diffFields(first.Before, second.After)
+	case first.Kind == Added && second.Kind == Removed:
+		if first.Before == nil {
+			return merged, false, true
+		}
+		merged.Kind = Removed
+	case first.Kind == Changed && second.Kind == Removed:
+		merged.Kind = Removed
+	default:
+		return merged, false, false
+	}
+	return merged, true, true
+}
+
+// diffFields returns the fields set and cleared going from one version of
+// a document to another.
+func diffFields(before, after map[string]interface{}) (map[string]interface{}, []string) {
+	fields := map[string]interface{}{}
+	for key, value := range after {
+		fields[key] = value
+	}
+	var cleared []string
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			cleared = append(cleared, key)
+		}
+	}
+	sort.Strings(cleared)
+	return fields, cleared
+}
+
+// appendUnique appends key to keys unless it is already present.
+func appendUnique(keys []string, key string) []string {
+	for _, existing := range keys {
+		if existing == key {
+			return keys
+		}
+	}
+	return append(keys, key)
+}
@@ -0,0 +1,174 @@
+package ddp_test
+
+import (
+	. "github.com/gopackage/ddp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher", func() {
+
+	var collection *KeyCache
+
+	add := func(id string, fields map[string]interface{}) {
+		collection.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": id, "fields": fields})
+	}
+	change := func(id string, fields map[string]interface{}, cleared ...interface{}) {
+		collection.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": id, "fields": fields, "cleared": cleared})
+	}
+	// watch starts a watcher and fills its hand over slot with a first
+	// event so the buffer state is predictable.
+	watch := func(size int, policy OverflowPolicy) *Watcher {
+		watcher := collection.Watch(size, policy)
+		add("first", nil)
+		Eventually(watcher.Pending).Should(BeZero())
+		return watcher
+	}
+	receiveIDs := func(watcher *Watcher, n int) []string {
+		ids := []string{}
+		for i := 0; i < n; i++ {
+			var event ChangeEvent
+			Eventually(watcher.Events()).Should(Receive(&event))
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+
+	BeforeEach(func() {
+		collection = NewCollection("builds").(*KeyCache)
+	})
+
+	It("should not block the collection", func() {
+		watcher := collection.Watch(0, DropOldest)
+		defer watcher.Stop()
+		for i := 0; i < 1000; i++ {
+			add("a", map[string]interface{}{"n": i})
+		}
+		Ω(watcher.Pending()).Should(BeNumerically(">=", 998))
+		Ω(watcher.Dropped()).Should(BeZero())
+	})
+
+	It("should drop the oldest events", func() {
+		watcher := watch(2, DropOldest)
+		defer watcher.Stop()
+		add("a", nil)
+		add("b", nil)
+		add("c", nil)
+		Ω(watcher.Dropped()).Should(Equal(int64(1)))
+		Ω(receiveIDs(watcher, 3)).Should(Equal([]string{"first", "b", "c"}))
+	})
+
+	It("should drop the newest events", func() {
+		watcher := watch(2, DropNewest)
+		defer watcher.Stop()
+		add("a", nil)
+		add("b", nil)
+		add("c", nil)
+		Ω(watcher.Dropped()).Should(Equal(int64(1)))
+		Ω(receiveIDs(watcher, 3)).Should(Equal([]string{"first", "a", "b"}))
+	})
+
+	It("should disconnect a watcher that falls behind", func() {
+		watcher := watch(2, Disconnect)
+		add("a", nil)
+		add("b", nil)
+		Ω(watcher.Err()).ShouldNot(HaveOccurred())
+		add("c", nil)
+		Ω(watcher.Err()).Should(Equal(ErrWatcherOverflow))
+		Eventually(watcher.Events()).Should(BeClosed())
+	})
+
+	It("should coalesce events for the same document", func() {
+		watcher := watch(2, CoalesceByID)
+		defer watcher.Stop()
+		add("a", map[string]interface{}{"name": "a", "status": "new", "owner": "ci"})
+		change("a", map[string]interface{}{"status": "running"})
+		add("b", map[string]interface{}{"name": "b"})
+		change("b", map[string]interface{}{"status": "running"}, "name")
+		change("b", map[string]interface{}{"status": "passed"})
+		Ω(watcher.Pending()).Should(Equal(2))
+		Ω(watcher.Dropped()).Should(BeZero())
+
+		var event ChangeEvent
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.ID).Should(Equal("first"))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Added))
+		Ω(event.After).Should(Equal(map[string]interface{}{"name": "a", "status": "running", "owner": "ci"}))
+		Ω(event.Fields).Should(Equal(event.After))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Added))
+		Ω(event.ID).Should(Equal("b"))
+		Ω(event.After).Should(Equal(map[string]interface{}{"status": "passed"}))
+	})
+
+	It("should merge consecutive changes", func() {
+		add("a", map[string]interface{}{"name": "a", "status": "new", "owner": "ci"})
+		watcher := watch(2, CoalesceByID)
+		defer watcher.Stop()
+		change("a", map[string]interface{}{"status": "running"}, "owner")
+		change("a", map[string]interface{}{"owner": "me"}, "name")
+		Ω(watcher.Pending()).Should(Equal(1))
+
+		var event ChangeEvent
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Changed))
+		Ω(event.Fields).Should(Equal(map[string]interface{}{"status": "running", "owner": "me"}))
+		Ω(event.Cleared).Should(Equal([]string{"name"}))
+		Ω(event.Before).Should(Equal(map[string]interface{}{"name": "a", "status": "new", "owner": "ci"}))
+		Ω(event.After).Should(Equal(map[string]interface{}{"status": "running", "owner": "me"}))
+	})
+
+	It("should cancel out documents added and removed while queued", func() {
+		watcher := watch(2, CoalesceByID)
+		defer watcher.Stop()
+		add("a", nil)
+		collection.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "a"})
+		Ω(watcher.Pending()).Should(BeZero())
+		collection.Reset()
+		Ω(receiveIDs(watcher, 2)).Should(Equal([]string{"first", ""}))
+	})
+
+	It("should keep positions when coalescing an ordered collection", func() {
+		ordered := NewOrderedCollection("builds").(*OrderedCache)
+		ordered.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "b"})
+		ordered.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "c"})
+		watcher := ordered.Watch(0, CoalesceByID)
+		defer watcher.Stop()
+		ordered.Added(map[string]interface{}{"msg": "added", "collection": "builds", "id": "first"})
+		Eventually(watcher.Pending).Should(BeZero())
+		ordered.AddedBefore(map[string]interface{}{"msg": "addedBefore", "collection": "builds", "id": "a", "before": "b"})
+		ordered.Changed(map[string]interface{}{"msg": "changed", "collection": "builds", "id": "a", "fields": map[string]interface{}{"n": 1.0}})
+		ordered.Removed(map[string]interface{}{"msg": "removed", "collection": "builds", "id": "c"})
+		ordered.AddedBefore(map[string]interface{}{"msg": "addedBefore", "collection": "builds", "id": "c", "before": "a"})
+
+		Ω(watcher.Pending()).Should(Equal(3))
+		var event ChangeEvent
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.ID).Should(Equal("first"))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Added))
+		Ω(event.ID).Should(Equal("a"))
+		Ω(event.BeforeID).Should(Equal("b"))
+		Ω(event.After).Should(Equal(map[string]interface{}{"n": 1.0}))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Removed))
+		Ω(event.ID).Should(Equal("c"))
+		Eventually(watcher.Events()).Should(Receive(&event))
+		Ω(event.Kind).Should(Equal(Added))
+		Ω(event.ID).Should(Equal("c"))
+		Ω(event.BeforeID).Should(Equal("a"))
+		Ω(ordered.IDs()).Should(Equal([]string{"c", "a", "b", "first"}))
+	})
+
+	It("should unregister", func() {
+		watcher := collection.Watch(0, DropOldest)
+		watcher.Stop()
+		Eventually(watcher.Events()).Should(BeClosed())
+		add("a", nil)
+		Ω(watcher.Pending()).Should(BeZero())
+		Ω(watcher.Err()).ShouldNot(HaveOccurred())
+	})
+})
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"time"
@@ -9,20 +10,20 @@ import (
 )
 
 func main() {
-	client, err := ddp.NewClient("ws://localhost:3000/websocket", "http://localhost/")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := ddp.DialContext(ctx, "ws://localhost:3000/websocket")
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer client.Close()
+	log.Printf("Connected DDP version: %s session: %s", client.Version(), client.Session())
 
 	err = client.Sub("builds", []interface{}{"abc"})
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	// We know client.Sub is synchronous and will only respond after we connect.
-	log.Printf("Connected DDP version: %s session: %s", client.Version(), client.Session())
-
 	builds := client.CollectionByName("builds")
 	log.Println("Collection: builds", len(builds.FindAll()))
 	for key, value := range builds.FindAll() {